@@ -2,4 +2,7 @@ module espd
 
 go 1.24.3
 
-require golang.org/x/sys v0.36.0
+require (
+	golang.org/x/net v0.44.0
+	golang.org/x/sys v0.36.0
+)
@@ -1,571 +1,3751 @@
-package main
-
-import (
-	"bufio"
-	"flag"
-	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"os/user"
-	"regexp"
-	"strings"
-	"time"
-
-	"golang.org/x/sys/windows/registry"
-)
-
-const (
-	serviceName        = "ESPDProxyService"
-	serviceDescription = "ESPD Proxy Configuration Service"
-	logFileName        = "espdproxy.log"
-	maxLogSize         = 15 * 1024 * 1024 // 15 MB
-	checkInterval      = 1 * time.Minute
-)
-
-var (
-	logFile       *os.File
-	logger        *log.Logger
-	targetGateway string
-	proxyServer   string
-	proxyOverride string
-	fullUserName  string
-	findUserName  string
-	checkMode     string
-)
-
-func main() {
-	// Парсим флаги
-	installFlag := flag.Bool("install", false, "Install as Windows service")
-	uninstallFlag := flag.Bool("uninstall", false, "Remove Windows service")
-	serviceFlag := flag.Bool("service", false, "Run as service (for internal use)")
-	testFlag := flag.Bool("test", false, "Test mode")
-	helpFlag := flag.Bool("help", false, "Show help")
-	hFlag := flag.Bool("h", false, "Show help")
-
-	// Параметры конфигурации
-	flag.StringVar(&targetGateway, "gateway", "192.168.1.1", "Target gateway IP address")
-	flag.StringVar(&proxyServer, "proxy", "10.0.66.52:3128", "Proxy server address:port")
-	flag.StringVar(&proxyOverride, "override", "192.168.*.*;192.25.*.*;<local>", "Proxy override list")
-	flag.StringVar(&fullUserName, "fullname", "", "Exact username match (requires full match)")
-	flag.StringVar(&findUserName, "findname", "", "Partial username match (contains text)")
-	flag.StringVar(&checkMode, "mode", "gateway", "Check mode: gateway, user, or both")
-
-	flag.Parse()
-
-	if *helpFlag || *hFlag {
-		printHelp()
-		return
-	}
-
-	if *installFlag {
-		installService()
-		return
-	}
-
-	if *uninstallFlag {
-		uninstallService()
-		return
-	}
-
-	if *serviceFlag {
-		runService()
-		return
-	}
-
-	if *testFlag {
-		testProxySetting()
-		return
-	}
-
-	// Запуск без параметров = тестовый режим
-	testProxySetting()
-}
-
-func initLogger() error {
-	tempDir := os.TempDir()
-	logPath := tempDir + "\\" + logFileName
-
-	if info, err := os.Stat(logPath); err == nil {
-		if info.Size() > maxLogSize {
-			os.Remove(logPath)
-			logToFile("Log file exceeded 15MB, created new one")
-		}
-	}
-
-	var err error
-	logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-
-	logger = log.New(logFile, "", log.LstdFlags)
-	return nil
-}
-
-func logToFile(message string) {
-	if logger != nil {
-		logger.Println(message)
-	}
-}
-
-func getCurrentUsername() (string, error) {
-	currentUser, err := user.Current()
-	if err != nil {
-		return "", err
-	}
-	return currentUser.Username, nil
-}
-
-func checkUserCondition() (bool, error) {
-	currentUser, err := getCurrentUsername()
-	if err != nil {
-		return false, err
-	}
-
-	logToFile(fmt.Sprintf("Current username: %s", currentUser))
-
-	// Проверяем полное совпадение
-	if fullUserName != "" {
-		if currentUser == fullUserName {
-			logToFile(fmt.Sprintf("Full username match: %s", fullUserName))
-			return true, nil
-		}
-		logToFile(fmt.Sprintf("Full username does not match: expected %s, got %s", fullUserName, currentUser))
-	}
-
-	// Проверяем частичное совпадение
-	if findUserName != "" {
-		if strings.Contains(currentUser, findUserName) {
-			logToFile(fmt.Sprintf("Partial username match: %s contains %s", currentUser, findUserName))
-			return true, nil
-		}
-		logToFile(fmt.Sprintf("Partial username not found: %s does not contain %s", currentUser, findUserName))
-	}
-
-	return false, nil
-}
-
-func getDefaultGateway() (string, error) {
-	cmd := exec.Command("route", "print", "-4")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("route print failed: %v", err)
-	}
-
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	networkDestPattern := regexp.MustCompile(`^\s*0\.0\.0\.0\s+0\.0\.0\.0\s+(\d+\.\d+\.\d+\.\d+)\s+.*$`)
-
-	var gateway string
-	foundDefaultRoute := false
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if matches := networkDestPattern.FindStringSubmatch(line); matches != nil && len(matches) > 1 {
-			gateway = matches[1]
-			foundDefaultRoute = true
-			break
-		}
-	}
-
-	if !foundDefaultRoute {
-		return "", fmt.Errorf("default gateway not found in routing table")
-	}
-
-	ipPattern := regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
-	if !ipPattern.MatchString(gateway) {
-		return "", fmt.Errorf("invalid gateway IP: %s", gateway)
-	}
-
-	return gateway, nil
-}
-
-func getActiveGateways() ([]string, error) {
-	cmd := exec.Command("netsh", "interface", "ip", "show", "config")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("netsh failed: %v", err)
-	}
-
-	var gateways []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-
-	gatewayPatterns := []*regexp.Regexp{
-		regexp.MustCompile(`Default Gateway[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
-		regexp.MustCompile(`Основной шлюз[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
-		regexp.MustCompile(`Шлюз, используемый по умолчанию[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
-	}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		for _, pattern := range gatewayPatterns {
-			if matches := pattern.FindStringSubmatch(line); matches != nil && len(matches) > 1 {
-				gateway := matches[1]
-				if gateway != "0.0.0.0" {
-					gateways = append(gateways, gateway)
-				}
-			}
-		}
-	}
-
-	if len(gateways) == 0 {
-		return nil, fmt.Errorf("no active gateways found")
-	}
-
-	return gateways, nil
-}
-
-func isTargetGatewayActive() (bool, error) {
-	defaultGateway, err := getDefaultGateway()
-	if err != nil {
-		gateways, err := getActiveGateways()
-		if err != nil {
-			return false, err
-		}
-
-		for _, gw := range gateways {
-			if gw == targetGateway {
-				return true, nil
-			}
-		}
-
-		return false, nil
-	}
-
-	return defaultGateway == targetGateway, nil
-}
-
-func shouldEnableProxy() (bool, error) {
-	switch checkMode {
-	case "gateway":
-		return isTargetGatewayActive()
-	case "user":
-		return checkUserCondition()
-	case "both":
-		gatewayOk, err := isTargetGatewayActive()
-		if err != nil {
-			return false, err
-		}
-		userOk, err := checkUserCondition()
-		if err != nil {
-			return false, err
-		}
-		return gatewayOk && userOk, nil
-	default:
-		return false, fmt.Errorf("unknown check mode: %s", checkMode)
-	}
-}
-
-func getCurrentProxySettings() (bool, string, error) {
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.READ)
-	if err != nil {
-		return false, "", err
-	}
-	defer k.Close()
-
-	enabled, _, err := k.GetIntegerValue("ProxyEnable")
-	if err != nil {
-		return false, "", err
-	}
-
-	server, _, err := k.GetStringValue("ProxyServer")
-	if err != nil {
-		server = ""
-	}
-
-	return enabled == 1, server, nil
-}
-
-func setProxy(enable bool) error {
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.ALL_ACCESS)
-	if err != nil {
-		return err
-	}
-	defer k.Close()
-
-	var enableValue uint32 = 0
-	if enable {
-		enableValue = 1
-	}
-
-	err = k.SetDWordValue("ProxyEnable", enableValue)
-	if err != nil {
-		return err
-	}
-
-	if enable {
-		err = k.SetStringValue("ProxyServer", proxyServer)
-		if err != nil {
-			return err
-		}
-
-		err = k.SetStringValue("ProxyOverride", proxyOverride)
-		if err != nil {
-			return err
-		}
-	}
-
-	cmd := exec.Command("rundll32", "user32.dll,UpdatePerUserSystemParameters")
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func testProxySetting() {
-	fmt.Println("=== ESPD Proxy Service Test Mode ===")
-	fmt.Printf("Check mode: %s\n", checkMode)
-
-	if checkMode == "gateway" || checkMode == "both" {
-		fmt.Printf("Target gateway: %s\n", targetGateway)
-	}
-	if checkMode == "user" || checkMode == "both" {
-		if fullUserName != "" {
-			fmt.Printf("Full username: %s\n", fullUserName)
-		}
-		if findUserName != "" {
-			fmt.Printf("Find username: %s\n", findUserName)
-		}
-	}
-	fmt.Printf("Proxy server: %s\n", proxyServer)
-	fmt.Printf("Proxy override: %s\n", proxyOverride)
-	fmt.Println("")
-
-	fmt.Println("Checking conditions...")
-
-	currentUser, err := getCurrentUsername()
-	if err != nil {
-		fmt.Printf("Error getting username: %v\n", err)
-	} else {
-		fmt.Printf("Current username: %s\n", currentUser)
-	}
-
-	var result bool
-	var reason string
-
-	switch checkMode {
-	case "gateway":
-		gatewayActive, err := isTargetGatewayActive()
-		if err != nil {
-			fmt.Printf("Error checking gateway: %v\n", err)
-			return
-		}
-		result = gatewayActive
-		reason = "gateway check"
-
-	case "user":
-		userOk, err := checkUserCondition()
-		if err != nil {
-			fmt.Printf("Error checking user: %v\n", err)
-			return
-		}
-		result = userOk
-		reason = "user check"
-
-	case "both":
-		gatewayActive, err := isTargetGatewayActive()
-		if err != nil {
-			fmt.Printf("Error checking gateway: %v\n", err)
-			return
-		}
-		userOk, err := checkUserCondition()
-		if err != nil {
-			fmt.Printf("Error checking user: %v\n", err)
-			return
-		}
-		result = gatewayActive && userOk
-		reason = "both gateway and user check"
-	}
-
-	if result {
-		fmt.Printf("✓ Conditions met (%s)\n", reason)
-		fmt.Println("Result: WOULD ENABLE PROXY")
-	} else {
-		fmt.Printf("✗ Conditions not met (%s)\n", reason)
-		fmt.Println("Result: WOULD DISABLE PROXY")
-	}
-
-	fmt.Println("")
-
-	enabled, server, err := getCurrentProxySettings()
-	if err != nil {
-		fmt.Printf("Error reading current proxy settings: %v\n", err)
-	} else {
-		status := "DISABLED"
-		if enabled {
-			status = "ENABLED"
-		}
-		fmt.Printf("Current proxy settings: %s (%s)\n", status, server)
-	}
-
-	fmt.Println("")
-	fmt.Println("Note: This is a test. No changes were made to system settings.")
-	fmt.Println("Use --install to install the service for actual operation.")
-}
-
-func checkAndSetProxy() {
-	shouldEnable, err := shouldEnableProxy()
-	if err != nil {
-		logToFile(fmt.Sprintf("Error checking conditions: %v", err))
-		return
-	}
-
-	logToFile(fmt.Sprintf("Configuration: mode=%s, gateway=%s, fullname=%s, findname=%s, proxy=%s",
-		checkMode, targetGateway, fullUserName, findUserName, proxyServer))
-
-	if shouldEnable {
-		logToFile("Conditions met, enabling proxy")
-		err := setProxy(true)
-		if err != nil {
-			logToFile(fmt.Sprintf("Error enabling proxy: %v", err))
-		} else {
-			logToFile("Proxy enabled successfully")
-		}
-	} else {
-		logToFile("Conditions not met, disabling proxy")
-		err := setProxy(false)
-		if err != nil {
-			logToFile(fmt.Sprintf("Error disabling proxy: %v", err))
-		} else {
-			logToFile("Proxy disabled successfully")
-		}
-	}
-}
-
-func runService() {
-	err := initLogger()
-	if err != nil {
-		log.Fatalf("Failed to initialize logger: %v", err)
-	}
-	defer logFile.Close()
-
-	logToFile("ESPD Proxy Service started")
-	logToFile(fmt.Sprintf("Service configuration: mode=%s, gateway=%s, fullname=%s, findname=%s, proxy=%s",
-		checkMode, targetGateway, fullUserName, findUserName, proxyServer))
-
-	ticker := time.NewTicker(checkInterval)
-	defer ticker.Stop()
-
-	checkAndSetProxy()
-
-	for range ticker.C {
-		checkAndSetProxy()
-	}
-}
-
-func installService() {
-	exePath, err := os.Executable()
-	if err != nil {
-		fmt.Printf("Error getting executable path: %v\n", err)
-		return
-	}
-
-	// Строим команду с параметрами
-	serviceArgs := fmt.Sprintf("\"%s --service --mode=%s --gateway=%s --proxy=%s --override=\"%s\"",
-		exePath, checkMode, targetGateway, proxyServer, proxyOverride)
-
-	if fullUserName != "" {
-		serviceArgs += fmt.Sprintf(" --fullname=\"%s\"", fullUserName)
-	}
-	if findUserName != "" {
-		serviceArgs += fmt.Sprintf(" --findname=\"%s\"", findUserName)
-	}
-	serviceArgs += "\""
-
-	cmd := exec.Command("sc", "create", serviceName,
-		"binPath=", serviceArgs,
-		"displayname=", serviceDescription,
-		"start=", "auto")
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("Error creating service: %v\nOutput: %s\n", err, output)
-		return
-	}
-
-	cmd = exec.Command("sc", "start", serviceName)
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("Error starting service: %v\nOutput: %s\n", err, output)
-		return
-	}
-
-	fmt.Printf("Service '%s' installed successfully with configuration:\n", serviceName)
-	fmt.Printf("  Mode: %s\n", checkMode)
-	if checkMode == "gateway" || checkMode == "both" {
-		fmt.Printf("  Gateway: %s\n", targetGateway)
-	}
-	if checkMode == "user" || checkMode == "both" {
-		if fullUserName != "" {
-			fmt.Printf("  Full username: %s\n", fullUserName)
-		}
-		if findUserName != "" {
-			fmt.Printf("  Find username: %s\n", findUserName)
-		}
-	}
-	fmt.Printf("  Proxy: %s\n", proxyServer)
-	fmt.Printf("  Override: %s\n", proxyOverride)
-}
-
-func uninstallService() {
-	cmd := exec.Command("sc", "stop", serviceName)
-	cmd.Run()
-
-	cmd = exec.Command("sc", "delete", serviceName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("Error deleting service: %v\nOutput: %s\n", err, output)
-		return
-	}
-
-	fmt.Printf("Service '%s' uninstalled successfully\n", serviceName)
-}
-
-func printHelp() {
-	fmt.Printf("ESPD Proxy Service\n")
-	fmt.Printf("Usage: %s [options]\n", os.Args[0])
-	fmt.Printf("\nOptions:\n")
-	fmt.Printf("  --install                Install as Windows service\n")
-	fmt.Printf("  --uninstall              Remove Windows service\n")
-	fmt.Printf("  --service                Run as service (for internal use)\n")
-	fmt.Printf("  --test                   Test mode\n")
-	fmt.Printf("  --help, -h               Show this help\n")
-	fmt.Printf("\nConfiguration options:\n")
-	fmt.Printf("  --mode string            Check mode: gateway, user, or both (default: gateway)\n")
-	fmt.Printf("  --gateway string         Target gateway IP (default: 192.168.1.1)\n")
-	fmt.Printf("  --fullname string        Exact username match (requires full match)\n")
-	fmt.Printf("  --findname string        Partial username match (contains text)\n")
-	fmt.Printf("  --proxy string           Proxy server address:port (default: 10.0.66.52:3128)\n")
-	fmt.Printf("  --override string        Proxy override list (default: 192.168.*.*;192.25.*.*;<local>)\n")
-	fmt.Printf("\nExamples:\n")
-	fmt.Printf("  # Check by gateway only (default)\n")
-	fmt.Printf("  %s --install --gateway=192.168.0.1\n", os.Args[0])
-	fmt.Printf("  # Check by exact username\n")
-	fmt.Printf("  %s --install --mode=user --fullname=DOMAIN\\username\n", os.Args[0])
-	fmt.Printf("  # Check by partial username\n")
-	fmt.Printf("  %s --install --mode=user --findname=admin\n", os.Args[0])
-	fmt.Printf("  # Check by both gateway and username\n")
-	fmt.Printf("  %s --install --mode=both --gateway=192.168.1.1 --findname=user\n", os.Args[0])
-	fmt.Printf("  # Test current username\n")
-	fmt.Printf("  %s --test --mode=user --fullname=DOMAIN\\username\n", os.Args[0])
-}
-
-// go mod init espв
-// go mod tidy
-// go run main.g
-// env GOOS=windows GOARCH=amd64 go build -o espd-proxy-service.exe
-// set GOOS=windows&& set GOARCH=amd64&& go build -o espd-proxy-service64.exe
-// set GOOS=windows&& set GOARCH=amd32&& go build -o espd-proxy-service32.exe
-//
-//Проверка по точному имени пользователя:
-//--install --mode=user --fullname="DOMAIN\username" --proxy=10.0.66.52:3128
-//Проверка по частичному имени:
-//--install --mode=user --findname="admin" --proxy=10.0.66.52:3128
-//Комбинированная проверка:
-//--install --mode=both --gateway=192.168.1.1 --findname="user" --proxy=10.0.66.52:3128
-//Тестирование пользователя:
-//--test --mode=user --fullname="DOMAIN\username"
-//Только шлюз (как раньше):
-//--install --mode=gateway --gateway=192.168.1.1
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"espd/proxy"
+)
+
+type logLevel = proxy.LogLevel
+
+const (
+	levelDebug = proxy.LevelDebug
+	levelInfo  = proxy.LevelInfo
+	levelWarn  = proxy.LevelWarn
+	levelError = proxy.LevelError
+)
+
+// logFields - дополнительные поля записи лога (mode, gateway, user, proxy_state)
+type logFields map[string]string
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+// Имя и описание службы можно переопределить через --service-name и
+// --service-desc, чтобы установить на машину несколько экземпляров
+var (
+	serviceName        = "ESPDProxyService"
+	serviceDescription = "ESPD Proxy Configuration Service"
+)
+
+const (
+	logFileName        = "espdproxy.log"
+	maxLogSize         = 15 * 1024 * 1024 // 15 MB
+	defaultInterval    = 1 * time.Minute
+	networkSettleDelay = 2 * time.Second
+	statusKey          = `SOFTWARE\ESPDProxyService`
+	verifyProxyTimeout = 3 * time.Second
+
+	// Пользовательский код управления службой (128-255): немедленная проверка
+	checkNowControl = svc.Cmd(128)
+)
+
+// Коды завершения процесса
+const (
+	exitOK            = 0
+	exitError         = 1
+	exitBadArgs       = 2
+	exitRegistryError = 3
+	exitServiceError  = 4
+	exitNotElevated   = 5
+	exitProxyDisabled = 10 // --apply: прокси выключен, ошибок нет
+)
+
+// Заполняются при сборке через -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "dev"
+)
+
+var (
+	iphlpapi              = windows.NewLazySystemDLL("iphlpapi.dll")
+	procNotifyAddrChange  = iphlpapi.NewProc("NotifyAddrChange")
+	procNotifyRouteChange = iphlpapi.NewProc("NotifyRouteChange")
+
+	wtsapi32           = windows.NewLazySystemDLL("wtsapi32.dll")
+	procWTSSendMessage = wtsapi32.NewProc("WTSSendMessageW")
+)
+
+var (
+	logFile       *os.File
+	logger        *log.Logger
+	consoleLogger *log.Logger
+	logToStdout   bool
+	eventLog      *eventlog.Log
+	logFilePath   string
+	logMutex      sync.Mutex
+	logKeep       int
+	logRotate     string
+	logBasePath   string
+	logDay        string
+	logFileFlag   bool
+	logPathFlag   string
+	logLevelFlag  string
+	logFormat     string
+	minLogLevel   = levelInfo
+	overrideFile  string
+	dryRun        bool
+	simulateGW    string
+	simulateUser  string
+	notifyUser    bool
+	keepProxy     bool
+	verifyProxy   bool
+	listenAddr    string
+	debounceCount int
+	restartDelay  time.Duration
+	applyInterval time.Duration
+	checkInterval time.Duration
+	maxInterval   time.Duration
+	profileName   string
+	noStart       bool
+	manualStart   bool
+	startTypeFlag string
+	jsonOutput    bool
+	auditMode     bool
+	passStored    bool
+	cfg           = proxy.Config{Logger: packageLogger{}}
+)
+
+func main() {
+	// Парсим флаги
+	installFlag := flag.Bool("install", false, "Install as Windows service")
+	uninstallFlag := flag.Bool("uninstall", false, "Remove Windows service")
+	reinstallFlag := flag.Bool("reinstall", false, "Replace the installed service with the current configuration")
+	serviceFlag := flag.Bool("service", false, "Run as service (for internal use)")
+	testFlag := flag.Bool("test", false, "Test mode")
+	flag.BoolVar(&jsonOutput, "json", false, "With --test: print the result as JSON")
+	onceAndWatchFlag := flag.Bool("once-and-watch", false, "Apply proxy settings now and keep watching network changes until logoff")
+	applyFlag := flag.Bool("apply", false, "Apply proxy settings once and exit (for logon scripts)")
+	validateFlag := flag.Bool("validate", false, "Validate configuration and exit")
+	configFlag := flag.String("config", "", "JSON configuration file")
+	printBinPathFlag := flag.Bool("print-binpath", false, "Print the service command line --install would register and exit")
+	refreshSessionFlag := flag.Bool("refresh-session", false, "Notify WinINET of changed proxy settings in this session (for internal use)")
+	exportConfigFlag := flag.String("export-config", "", "Write the effective configuration to a JSON file and exit")
+	versionFlag := flag.Bool("version", false, "Show version")
+	listGatewaysFlag := flag.Bool("list-gateways", false, "Show detected gateways and exit")
+	updateFlag := flag.String("update", "", "Download a new executable from this HTTPS URL and replace the installed one")
+	updateSHAFlag := flag.String("update-sha", "", "Expected SHA-256 of the --update download (hex)")
+	checkNowFlag := flag.Bool("check-now", false, "Ask the running service to check conditions immediately")
+	disableNowFlag := flag.Bool("disable-now", false, "Stop the service, disable the proxy and keep it disabled until --enable-now")
+	enableNowFlag := flag.Bool("enable-now", false, "Clear --disable-now and start the service again")
+	diagnoseFlag := flag.Bool("diagnose", false, "Print a full diagnostic report for support tickets")
+	whoamiFlag := flag.Bool("whoami", false, "Show the current user names and whether they match")
+	helpFlag := flag.Bool("help", false, "Show help")
+	hFlag := flag.Bool("h", false, "Show help")
+
+	flag.BoolVar(&logFileFlag, "logfile", true, "Write log to file (in addition to Event Log in service mode)")
+	flag.StringVar(&logLevelFlag, "loglevel", "INFO", "Log level: DEBUG, INFO, WARN, or ERROR")
+	verboseFlag := flag.Bool("verbose", false, "Shorthand for --loglevel=DEBUG")
+	quietFlag := flag.Bool("quiet", false, "Shorthand for --loglevel=ERROR")
+	flag.StringVar(&logFormat, "logformat", "text", "Log format: text or json")
+	flag.IntVar(&logKeep, "logkeep", 3, "Number of rotated log files to keep")
+	flag.BoolVar(&logToStdout, "log-to-stdout", false, "Also print log entries to the console (stderr with --json)")
+	flag.StringVar(&logRotate, "logrotate", "", "Start a new log file every day: daily (default: by size only)")
+	flag.StringVar(&logPathFlag, "logpath", "", "Log file path or directory (default: %TEMP%\\espdproxy.log)")
+
+	// Параметры конфигурации
+	flag.StringVar(&cfg.Gateway, "gateway", "192.168.1.1", "Target gateway: IP address, CIDR, or prefix like 192.168. or 10.0.*")
+	flag.StringVar(&cfg.GatewaySites, "gateway-sites", "", "Labeled target gateways, e.g. site1=10.0.1.1;site2=10.0.2.1 (replaces --gateway)")
+	flag.StringVar(&cfg.GatewayIface, "gateway-iface", "", "Require the gateway on this interface (adapter name or index)")
+	flag.StringVar(&cfg.GatewayIface, "gateway-adapter", "", "Same as --gateway-iface")
+	flag.BoolVar(&cfg.PingCheck, "ping-check", false, "Require the matched gateway to answer an ICMP echo")
+	flag.DurationVar(&cfg.PingTimeout, "ping-timeout", 2*time.Second, "Timeout for --ping-check")
+	flag.StringVar(&cfg.InterfaceInclude, "interface-include", "", "Only consider adapters whose name or description contains one of these (';'-separated)")
+	flag.StringVar(&cfg.InterfaceExclude, "interface-exclude", "", "Ignore adapters whose name or description contains one of these (';'-separated)")
+	flag.StringVar(&cfg.Server, "proxy", "10.0.66.52:3128", "Proxy server address:port, or a comma-separated failover list")
+	flag.StringVar(&cfg.HTTP, "proxy-http", "", "HTTP proxy server address:port")
+	flag.StringVar(&cfg.HTTPS, "proxy-https", "", "HTTPS proxy server address:port")
+	flag.StringVar(&cfg.FTP, "proxy-ftp", "", "FTP proxy server address:port")
+	flag.StringVar(&cfg.ProxyUser, "proxy-user", "", "Username embedded into the proxy address (user:pass@host:port)")
+	flag.StringVar(&cfg.ProxyPassword, "proxy-pass", "", "Password for --proxy-user, never written to the log")
+	flag.BoolVar(&passStored, "proxy-pass-stored", false, "Read --proxy-pass from the protected registry key written by --install (for internal use)")
+	flag.StringVar(&cfg.Override, "override", "192.168.*.*;192.25.*.*;<local>", "Proxy override list")
+	flag.BoolVar(&cfg.AutoLocalBypass, "auto-local-bypass", false, "Add the machine's own subnets to the proxy override list")
+	flag.StringVar(&cfg.BypassDomains, "bypass-domains", "", "Domains to bypass the proxy, e.g. *.intranet.local;portal.espd.ru")
+	flag.StringVar(&cfg.FullUserName, "fullname", "", "Exact username match, semicolon-separated list allowed")
+	flag.StringVar(&cfg.FindUserName, "findname", "", "Partial username match, semicolon-separated list allowed")
+	flag.StringVar(&cfg.Hostname, "hostname", "", "Exact computer name match for mode hostname (';' list)")
+	flag.StringVar(&cfg.HostnameFind, "hostname-find", "", "Partial computer name match for mode hostname, e.g. ESPD-KIOSK-")
+	flag.StringVar(&cfg.ExcludeFullName, "exclude-fullname", "", "Never enable the proxy for these exact usernames (';' list)")
+	flag.StringVar(&cfg.ExcludeFindName, "exclude-findname", "", "Never enable the proxy for usernames containing these parts (';' list)")
+	flag.StringVar(&cfg.NameRegex, "nameregex", "", "Regular expression username match")
+	flag.BoolVar(&cfg.CaseSensitive, "case-sensitive", false, "Compare usernames with exact casing")
+	flag.StringVar(&cfg.Group, "group", "", "Group membership match (group name, DOMAIN\\group or SID)")
+	flag.StringVar(&cfg.SID, "sid", "", "User SID match for mode sid; a trailing * matches by prefix (';' list)")
+	flag.StringVar(&cfg.SSID, "ssid", "", "Wireless network SSID to match")
+	flag.StringVar(&cfg.DNSSuffix, "dnssuffix", "", "Connection-specific DNS suffix to match")
+	flag.StringVar(&cfg.DNSServer, "dns-server", "", "DNS server address(es) to match, separated by ';' (mode dns)")
+	flag.StringVar(&cfg.GatewayMAC, "gatewaymac", "", "MAC address of the default gateway to match")
+	flag.BoolVar(&cfg.ARPPing, "arp-ping", false, "Ping the gateway to populate the ARP table before MAC lookup")
+	flag.StringVar(&cfg.Probe, "probe", "", "Internal host:port that must be reachable")
+	flag.DurationVar(&cfg.ProbeTimeout, "probe-timeout", 3*time.Second, "TCP dial timeout for --probe")
+	flag.IntVar(&cfg.DHCPOption, "dhcp-option", 0, "DHCP option code for mode dhcpoption")
+	flag.StringVar(&cfg.DHCPValue, "dhcp-value", "", "Expected DHCP option value (text or hex) for mode dhcpoption")
+	flag.StringVar(&cfg.CheckCommand, "check-command", "", "Command for mode script: exit code 0 enables the proxy")
+	flag.DurationVar(&cfg.CheckTimeout, "check-timeout", 30*time.Second, "Timeout for --check-command")
+	flag.StringVar(&cfg.VPNPattern, "vpn-pattern", "", "Regular expression for VPN adapter names or descriptions (mode vpn)")
+	flag.BoolVar(&cfg.VPNForcesOn, "vpn-forces-on", false, "Always enable the proxy while a VPN adapter is connected")
+	flag.BoolVar(&cfg.SkipMetered, "skip-metered", false, "Keep the proxy disabled on metered connections")
+	flag.StringVar(&cfg.Mode, "mode", "gateway", "Check mode: gateway, user, group, sid, ssid, dnssuffix, dns, reachable, gatewaymac, vpn, hostname, dhcpoption, script, or both")
+	flag.IntVar(&cfg.Retries, "retries", 3, "Gateway detection attempts before giving up")
+	flag.StringVar(&profileName, "profile", "", "Profile name: separate service, status key and log file for this configuration")
+	flag.StringVar(&serviceName, "service-name", serviceName, "Windows service name (for several instances on one machine)")
+	flag.StringVar(&serviceDescription, "service-desc", serviceDescription, "Windows service display name and description")
+	flag.BoolVar(&noStart, "no-start", false, "Install the service without starting it")
+	flag.BoolVar(&manualStart, "manual", false, "Install the service with manual start instead of automatic")
+	flag.StringVar(&startTypeFlag, "start-type", "auto", "Service start type: auto, delayed-auto, manual, or disabled")
+	flag.DurationVar(&restartDelay, "restart-delay", 60*time.Second, "Delay before the SCM restarts a crashed service")
+	flag.BoolVar(&keepProxy, "keep-proxy", false, "Do not disable proxy on --uninstall")
+	flag.BoolVar(&verifyProxy, "verify-proxy", false, "Check that the proxy accepts TCP connections after enabling it")
+	flag.BoolVar(&notifyUser, "notify", false, "Show a notification to the console user when proxy state changes")
+	flag.BoolVar(&cfg.Invert, "invert", false, "Invert the decision: disable proxy when conditions match")
+	flag.StringVar(&cfg.Hours, "hours", "", "Time window when the proxy may be enabled, e.g. 08:00-18:00")
+	flag.StringVar(&cfg.Days, "days", "", "Days when the proxy may be enabled, e.g. Mon-Fri or Mon,Wed,Fri")
+	flag.BoolVar(&cfg.NoRefresh, "no-refresh", false, "Skip the UpdatePerUserSystemParameters refresh after writing settings")
+	flag.BoolVar(&cfg.AllSessions, "all-sessions", false, "Write proxy settings for the users of all active and disconnected sessions, checking each user separately (service mode)")
+	flag.BoolVar(&cfg.NoRestore, "no-restore", false, "Do not save and restore the user's own proxy settings, just disable the proxy")
+	flag.BoolVar(&cfg.ServerOnly, "update-server-only", false, "Only change ProxyServer/ProxyOverride, never ProxyEnable")
+	flag.BoolVar(&cfg.GPO, "gpo", false, "Also write the proxy into Group Policy registry keys that override HKCU")
+	flag.BoolVar(&cfg.WinHTTP, "winhttp", false, "Also set the machine-wide WinHTTP proxy")
+	flag.BoolVar(&cfg.DotNet, "dotnet", false, "Also write <defaultProxy> to .NET Framework machine.config files")
+	flag.DurationVar(&checkInterval, "interval", defaultInterval, "Time between periodic checks")
+	flag.DurationVar(&maxInterval, "max-interval", 0, "Let the check interval grow up to this value while nothing changes")
+	flag.DurationVar(&applyInterval, "min-apply-interval", 0, "Minimum time between proxy state changes (e.g. 5m)")
+	flag.IntVar(&debounceCount, "debounce", 1, "Consecutive agreeing checks required before changing proxy state")
+	flag.StringVar(&listenAddr, "listen", "", "Address for the health/status HTTP endpoint (e.g. :8085, localhost only by default)")
+	flag.BoolVar(&dryRun, "dryrun", false, "Only log what would be done, do not change proxy settings")
+	flag.BoolVar(&auditMode, "audit", false, "Never change settings, log desired vs actual proxy state and warn on drift")
+	flag.StringVar(&simulateGW, "simulate-gateway", "", "Pretend this IP is the default gateway (test, dry-run and diagnostics only)")
+	flag.StringVar(&simulateUser, "simulate-user", "", "Pretend to run as this user (test, dry-run and diagnostics only)")
+
+	flag.Parse()
+
+	// Приоритет: командная строка > переменные ESPD_* > --config > значения по умолчанию
+	envErr := loadEnvironment()
+	configErr := loadConfigFile(*configFlag)
+	overrideErr := loadOverrideFile()
+
+	if *validateFlag {
+		os.Exit(validateConfig(envErr, configErr, overrideErr))
+	}
+	if envErr != nil {
+		fmt.Printf("Error: %v\n", envErr)
+		os.Exit(exitBadArgs)
+	}
+	if configErr != nil {
+		fmt.Printf("Error: %v\n", configErr)
+		os.Exit(exitBadArgs)
+	}
+	if overrideErr != nil {
+		fmt.Printf("Error: %v\n", overrideErr)
+		os.Exit(exitBadArgs)
+	}
+	if err := applyProfile(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if *verboseFlag {
+		logLevelFlag = "DEBUG"
+	}
+	if *quietFlag {
+		logLevelFlag = "ERROR"
+	}
+	level, err := parseLogLevel(logLevelFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+	minLogLevel = level
+
+	if logFormat != "text" && logFormat != "json" {
+		fmt.Printf("Error: unknown log format: %s\n", logFormat)
+		os.Exit(exitBadArgs)
+	}
+	if logRotate != "" && logRotate != "daily" {
+		fmt.Printf("Error: unknown --logrotate value: %s (expected daily)\n", logRotate)
+		os.Exit(exitBadArgs)
+	}
+	if logToStdout {
+		initConsoleLogger()
+	}
+
+	if err := cfg.CompileNameRegex(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := cfg.CompileUserPatterns(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := cfg.CompileVPNPattern(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := validateIntervals(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := cfg.ValidateDHCPOption(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := cfg.ValidateDNSServer(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if err := cfg.ParseSchedule(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if *helpFlag || *hFlag {
+		printHelp()
+		return
+	}
+
+	if *versionFlag {
+		fmt.Println(versionString())
+		return
+	}
+
+	// Служба с --all-sessions запускает эту команду в сеансе пользователя
+	if *refreshSessionFlag {
+		cfg.Refresh()
+		return
+	}
+
+	// Подмена шлюза и пользователя допустима в диагностике и там, где настройки
+	// не меняются, в том числе в --service --dryrun. Команды установки,
+	// управления службой и обновления её игнорируют
+	diagnostics := *whoamiFlag || *diagnoseFlag || *listGatewaysFlag
+	otherCommand := *printBinPathFlag || *exportConfigFlag != "" || *installFlag || *reinstallFlag ||
+		*uninstallFlag || *checkNowFlag || *disableNowFlag || *enableNowFlag || *updateFlag != ""
+	changesSettings := *applyFlag || *onceAndWatchFlag || *serviceFlag
+	if err := applySimulation(diagnostics || (!otherCommand && (*testFlag || dryRun || !changesSettings))); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitBadArgs)
+	}
+
+	if *whoamiFlag {
+		whoami()
+		return
+	}
+
+	if *diagnoseFlag {
+		diagnose()
+		return
+	}
+
+	if *listGatewaysFlag {
+		listGateways()
+		return
+	}
+
+	if *printBinPathFlag {
+		os.Exit(printBinPath())
+	}
+
+	if *exportConfigFlag != "" {
+		os.Exit(exportConfig(*exportConfigFlag))
+	}
+
+	if *installFlag {
+		os.Exit(installService())
+	}
+
+	if *reinstallFlag {
+		os.Exit(reinstallService())
+	}
+
+	if *uninstallFlag {
+		os.Exit(uninstallService())
+	}
+
+	if *checkNowFlag {
+		os.Exit(checkNowService())
+	}
+
+	if *disableNowFlag {
+		os.Exit(disableNow())
+	}
+
+	if *enableNowFlag {
+		os.Exit(enableNow())
+	}
+
+	if *updateFlag != "" {
+		os.Exit(selfUpdate(*updateFlag, *updateSHAFlag))
+	}
+
+	if *serviceFlag {
+		runService()
+		return
+	}
+
+	if *testFlag {
+		testProxySetting()
+		return
+	}
+
+	if *applyFlag {
+		os.Exit(applyOnce())
+	}
+
+	if *onceAndWatchFlag {
+		os.Exit(onceAndWatch())
+	}
+
+	// Запуск без параметров = тестовый режим
+	testProxySetting()
+}
+
+// applySimulation подставляет --simulate-gateway и --simulate-user вместо
+// системных источников. Вне тестового режима, --dryrun и диагностики
+// (--whoami, --diagnose, --list-gateways) они игнорируются.
+// Сообщения идут в stderr, чтобы не портить вывод --json
+func applySimulation(allowed bool) error {
+	if simulateGW == "" && simulateUser == "" {
+		return nil
+	}
+	if !allowed {
+		fmt.Fprintln(os.Stderr, "Warning: --simulate-gateway and --simulate-user are ignored without --test, --dryrun, --whoami, --diagnose or --list-gateways")
+		return nil
+	}
+
+	if simulateGW != "" {
+		if net.ParseIP(simulateGW).To4() == nil {
+			return fmt.Errorf("invalid --simulate-gateway %q, expected an IPv4 address", simulateGW)
+		}
+		cfg.Gateways = proxy.SimulatedGateways{Gateway: simulateGW}
+		fmt.Fprintf(os.Stderr, "Simulating default gateway: %s\n", simulateGW)
+	}
+	if simulateUser != "" {
+		cfg.Users = proxy.SimulatedUsers{User: simulateUser}
+		fmt.Fprintf(os.Stderr, "Simulating user: %s\n", simulateUser)
+	}
+	return nil
+}
+
+// explicitFlags возвращает флаги, уже заданные командной строкой или окружением
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// envName возвращает имя переменной окружения для флага:
+// --mode -> ESPD_MODE, --proxy-http -> ESPD_PROXY_HTTP
+func envName(flagName string) string {
+	return "ESPD_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// applyProfile разводит экземпляры с разными --profile: к имени службы,
+// ключу состояния и лог-файлу добавляется имя профиля. Явно заданные
+// --service-name и --service-desc не меняются
+func applyProfile() error {
+	if profileName == "" {
+		return nil
+	}
+	if !profileNamePattern.MatchString(profileName) {
+		return fmt.Errorf("invalid profile name %q: only letters, digits, '-' and '_' are allowed", profileName)
+	}
+
+	explicit := explicitFlags()
+	if !explicit["service-name"] {
+		serviceName += "-" + profileName
+	}
+	if !explicit["service-desc"] {
+		serviceDescription += " (" + profileName + ")"
+	}
+	return nil
+}
+
+// statusKeyPath возвращает ключ HKLM с результатом последней проверки
+func statusKeyPath() string {
+	if profileName == "" {
+		return statusKey
+	}
+	return statusKey + "-" + profileName
+}
+
+// profileLogFileName возвращает имя лог-файла: espdproxy.log или espdproxy-<profile>.log
+func profileLogFileName() string {
+	if profileName == "" {
+		return logFileName
+	}
+	return strings.TrimSuffix(logFileName, filepath.Ext(logFileName)) + "-" + profileName + filepath.Ext(logFileName)
+}
+
+// loadEnvironment применяет переменные ESPD_* к флагам, не заданным в командной
+// строке. Вызывается до loadConfigFile, поэтому файл их уже не перекрывает
+func loadEnvironment() error {
+	explicit := explicitFlags()
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || (commandFlags[f.Name] && f.Name != "config") {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value in %s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// loadConfigFile читает JSON-файл вида {"mode": "both", "gateway": "192.168.1.1"}.
+// Ключи совпадают с именами флагов; командная строка и переменные ESPD_* имеют приоритет
+func loadConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config %s: %v", path, err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("cannot parse config %s: %v", path, err)
+	}
+
+	explicit := explicitFlags()
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("config %s: unknown option %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		// Площадки можно задать списком объектов {"label": ..., "gateway": ...}
+		if name == "gateway-sites" {
+			if list, ok := value.([]interface{}); ok {
+				if value, err = gatewaySitesValue(list); err != nil {
+					return fmt.Errorf("config %s: invalid value for %q: %v", path, name, err)
+				}
+			}
+		}
+		if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config %s: invalid value for %q: %v", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// gatewaySitesValue переводит список площадок из JSON в формат --gateway-sites
+func gatewaySitesValue(list []interface{}) (string, error) {
+	var entries []string
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("expected {\"label\": ..., \"gateway\": ...} entries")
+		}
+		label, _ := entry["label"].(string)
+		gateway, _ := entry["gateway"].(string)
+		if label == "" || gateway == "" {
+			return "", fmt.Errorf("each entry needs label and gateway")
+		}
+		entries = append(entries, label+"="+gateway)
+	}
+	return strings.Join(entries, ";"), nil
+}
+
+// commandFlags - флаги действий, которые не относятся к конфигурации
+// и не попадают в --export-config
+var commandFlags = map[string]bool{
+	"install": true, "no-start": true, "uninstall": true, "reinstall": true, "service": true, "test": true, "json": true, "apply": true, "once-and-watch": true,
+	"validate": true, "list-gateways": true, "whoami": true, "check-now": true, "disable-now": true, "enable-now": true, "diagnose": true, "update": true, "update-sha": true, "simulate-gateway": true, "simulate-user": true, "config": true, "export-config": true, "print-binpath": true, "proxy-pass-stored": true, "refresh-session": true, "version": true,
+	"help": true, "h": true, "verbose": true, "quiet": true,
+}
+
+// secretFlags не сохраняются в файл, их нужно передать отдельно
+var secretFlags = map[string]bool{
+	"proxy-pass": true,
+}
+
+// exportConfig сохраняет действующие значения всех параметров в формате,
+// который читает --config
+func exportConfig(path string) int {
+	values := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] || secretFlags[f.Name] {
+			return
+		}
+		// Числа и логические значения сохраняются как есть, остальное (включая
+		// длительности) - строкой, чтобы flag.Set разобрал их обратно
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case bool, int:
+			values[f.Name] = v
+		default:
+			values[f.Name] = f.Value.String()
+		}
+	})
+	if overrideFile != "" {
+		values["override"] = "@" + overrideFile
+	}
+
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding configuration: %v\n", err)
+		return exitError
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", path, err)
+		return exitError
+	}
+
+	fmt.Printf("Configuration exported to %s\n", path)
+	if cfg.ProxyPassword != "" {
+		fmt.Println("Note: --proxy-pass is not exported, pass it on the command line or in ESPD_PROXY_PASS")
+	}
+	return exitOK
+}
+
+// loadOverrideFile обрабатывает синтаксис --override=@path.txt: одна запись
+// на строку, # - комментарий, <local> добавляется автоматически
+func loadOverrideFile() error {
+	if !strings.HasPrefix(cfg.Override, "@") {
+		return nil
+	}
+
+	path, err := filepath.Abs(strings.TrimPrefix(cfg.Override, "@"))
+	if err != nil {
+		return fmt.Errorf("invalid override file path: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read override file: %v", err)
+	}
+
+	var entries []string
+	hasLocal := false
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.EqualFold(line, "<local>") {
+			hasLocal = true
+		}
+		entries = append(entries, line)
+	}
+	if !hasLocal {
+		entries = append(entries, "<local>")
+	}
+
+	overrideFile = path
+	cfg.Override = strings.Join(entries, ";")
+	return nil
+}
+
+// validateConfig проверяет конфигурацию без обращения к сети и реестру
+func validateConfig(envErr, configErr, overrideErr error) int {
+	fmt.Println("=== ESPD Proxy Service Configuration Validation ===")
+
+	_, logLevelErr := parseLogLevel(logLevelFlag)
+
+	checks := []struct {
+		name string
+		err  error
+	}{
+		{"environment", envErr},
+		{"config file", configErr},
+		{"override file", overrideErr},
+		{"mode", cfg.ValidateMode()},
+		{"gateway", cfg.ValidateGateway()},
+		{"proxy", cfg.ValidateProxy()},
+		{"override", cfg.ValidateOverride()},
+		{"username regex", cfg.CompileNameRegex()},
+		{"username patterns", cfg.CompileUserPatterns()},
+		{"VPN pattern", cfg.CompileVPNPattern()},
+		{"DHCP option", cfg.ValidateDHCPOption()},
+		{"DNS server", cfg.ValidateDNSServer()},
+		{"schedule", cfg.ParseSchedule()},
+		{"log level", logLevelErr},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if check.err != nil {
+			fmt.Printf("✗ %s: %v\n", check.name, check.err)
+			failed++
+		} else {
+			fmt.Printf("✓ %s\n", check.name)
+		}
+	}
+
+	fmt.Println("")
+	if failed > 0 {
+		fmt.Printf("Result: FAIL (%d problem(s) found)\n", failed)
+		return exitBadArgs
+	}
+	fmt.Println("Result: PASS")
+	return exitOK
+}
+
+func versionString() string {
+	return fmt.Sprintf("ESPD Proxy Service version %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// resolveLogPath возвращает путь к лог-файлу: --logpath может указывать
+// как на файл, так и на каталог, по умолчанию используется %TEMP%
+func resolveLogPath() string {
+	if logPathFlag == "" {
+		return filepath.Join(os.TempDir(), profileLogFileName())
+	}
+
+	if info, err := os.Stat(logPathFlag); err == nil && info.IsDir() {
+		return filepath.Join(logPathFlag, profileLogFileName())
+	}
+	if filepath.Ext(logPathFlag) == "" {
+		return filepath.Join(logPathFlag, profileLogFileName())
+	}
+	return logPathFlag
+}
+
+func initLogger() error {
+	logBasePath = resolveLogPath()
+	logFilePath = logBasePath
+	if logRotate == "daily" {
+		logDay = time.Now().Format("2006-01-02")
+		logFilePath = datedLogPath(logBasePath, logDay)
+		pruneDailyLogs()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logFilePath), 0755); err != nil {
+		return err
+	}
+
+	rotated := false
+	if info, err := os.Stat(logFilePath); err == nil {
+		if info.Size() > maxLogSize {
+			if err := rotateLogFiles(logFilePath, logKeep); err != nil {
+				return err
+			}
+			rotated = true
+		}
+	}
+
+	if err := openLogFile(); err != nil {
+		return err
+	}
+
+	if rotated {
+		logInfo("Log file exceeded 15MB, rotated to " + logFilePath + ".1")
+	}
+	return nil
+}
+
+func openLogFile() error {
+	var err error
+	logFile, err = os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	// В JSON время пишется в поле timestamp, префикс log не нужен
+	flags := log.LstdFlags
+	if logFormat == "json" {
+		flags = 0
+	}
+	logger = log.New(logFile, "", flags)
+	return nil
+}
+
+// rotateLogFiles сдвигает резервные копии (.1 -> .2 и т.д.), удаляя самую
+// старую, и переименовывает текущий файл в .1. При keep <= 0 файл удаляется
+func rotateLogFiles(path string, keep int) error {
+	if keep <= 0 {
+		return os.Remove(path)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+
+	return os.Rename(path, path+".1")
+}
+
+// rotateIfNeeded вызывается под logMutex: открытый файл закрывается
+// перед переименованием, иначе Windows не даст его переместить
+func rotateIfNeeded() {
+	info, err := logFile.Stat()
+	if err != nil || info.Size() <= maxLogSize {
+		return
+	}
+
+	logFile.Close()
+	logger = nil
+
+	if err := rotateLogFiles(logFilePath, logKeep); err != nil {
+		log.Printf("Failed to rotate log file: %v", err)
+	}
+	if err := openLogFile(); err != nil {
+		log.Printf("Failed to reopen log file: %v", err)
+	}
+}
+
+// datedLogPath - имя файла за день: espdproxy.log -> espdproxy-2006-01-02.log
+func datedLogPath(path, day string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + day + ext
+}
+
+// pruneDailyLogs оставляет текущий дневной файл и logKeep предыдущих.
+// Копии .1, .2 ротации по размеру удаляются вместе со своим днём
+func pruneDailyLogs() {
+	ext := filepath.Ext(logBasePath)
+	base := strings.TrimSuffix(filepath.Base(logBasePath), ext)
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(base) + `-(\d{4}-\d{2}-\d{2})` + regexp.QuoteMeta(ext) + `(\.\d+)?$`)
+
+	entries, err := os.ReadDir(filepath.Dir(logBasePath))
+	if err != nil {
+		return
+	}
+	var days []string
+	files := make(map[string][]string)
+	for _, entry := range entries {
+		matches := pattern.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+		if files[matches[1]] == nil {
+			days = append(days, matches[1])
+		}
+		files[matches[1]] = append(files[matches[1]], entry.Name())
+	}
+
+	sort.Strings(days)
+	for len(days) > max(logKeep, 0)+1 {
+		for _, name := range files[days[0]] {
+			os.Remove(filepath.Join(filepath.Dir(logBasePath), name))
+		}
+		days = days[1:]
+	}
+}
+
+// rolloverIfNeeded вызывается под logMutex: при --logrotate daily после
+// полуночи закрывает файл прошедшего дня и открывает новый
+func rolloverIfNeeded() {
+	if logRotate != "daily" {
+		return
+	}
+	day := time.Now().Format("2006-01-02")
+	if day == logDay {
+		return
+	}
+
+	logFile.Close()
+	logger = nil
+
+	logDay = day
+	logFilePath = datedLogPath(logBasePath, logDay)
+	pruneDailyLogs()
+	if err := openLogFile(); err != nil {
+		log.Printf("Failed to open log file for %s: %v", day, err)
+	}
+}
+
+// initConsoleLogger дублирует лог в консоль (--log-to-stdout). При --json
+// stdout занят отчётом, поэтому записи идут в stderr
+func initConsoleLogger() {
+	out := os.Stdout
+	if jsonOutput {
+		out = os.Stderr
+	}
+	flags := log.LstdFlags
+	if logFormat == "json" {
+		flags = 0
+	}
+	consoleLogger = log.New(out, "", flags)
+}
+
+func logToFile(message string) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if consoleLogger != nil {
+		consoleLogger.Println(message)
+	}
+	if logger != nil {
+		rolloverIfNeeded()
+	}
+	if logger != nil {
+		logger.Println(message)
+		rotateIfNeeded()
+	}
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+func formatLogEntry(level logLevel, message string, fields logFields) string {
+	if logFormat == "json" {
+		entry := map[string]string{
+			"timestamp": time.Now().Format(time.RFC3339),
+			"level":     logLevelNames[level],
+			"message":   message,
+		}
+		for key, value := range fields {
+			entry[key] = value
+		}
+		data, err := json.Marshal(entry)
+		if err == nil {
+			return string(data)
+		}
+	}
+
+	text := fmt.Sprintf("[%s] %s", logLevelNames[level], message)
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		text += fmt.Sprintf(" %s=%s", key, fields[key])
+	}
+	return text
+}
+
+func logWithFields(level logLevel, message string, fields logFields) {
+	if level < minLogLevel {
+		return
+	}
+	logToFile(formatLogEntry(level, message, fields))
+}
+
+func logAt(level logLevel, message string) {
+	logWithFields(level, message, nil)
+}
+
+func logDebug(message string) {
+	logAt(levelDebug, message)
+}
+
+func logInfo(message string) {
+	logAt(levelInfo, message)
+}
+
+func logWarn(message string) {
+	logAt(levelWarn, message)
+}
+
+// Ошибки дублируются в журнал событий Windows
+func logError(message string) {
+	logAt(levelError, message)
+	if eventLog != nil {
+		eventLog.Error(1, message)
+	}
+}
+
+// Журнал событий Windows используется только в режиме службы
+func initEventLog() error {
+	var err error
+	eventLog, err = eventlog.Open(serviceName)
+	return err
+}
+
+// packageLogger направляет сообщения пакета proxy в лог службы
+type packageLogger struct{}
+
+func (packageLogger) Log(level proxy.LogLevel, message string, fields map[string]string) {
+	logWithFields(level, message, fields)
+}
+
+func logEvent(message string, fields logFields) {
+	logWithFields(levelInfo, message, fields)
+	if eventLog != nil {
+		eventLog.Info(1, message)
+	}
+}
+
+// logChange пишет в журнал событий только смену состояния прокси: повторные
+// проверки с тем же результатом попадают лишь в лог-файл
+func logChange(changed bool, message string, fields logFields) {
+	if changed {
+		logEvent(message, fields)
+		return
+	}
+	logWithFields(levelInfo, message, fields)
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func testProxySetting() {
+	if jsonOutput {
+		testProxySettingJSON()
+		return
+	}
+
+	fmt.Println("=== ESPD Proxy Service Test Mode ===")
+	fmt.Printf("Check mode: %s\n", cfg.Mode)
+
+	if cfg.Mode == "gateway" || cfg.Mode == "both" {
+		if cfg.GatewaySites != "" {
+			fmt.Printf("Target gateway sites: %s\n", cfg.GatewaySites)
+		} else {
+			fmt.Printf("Target gateway: %s\n", cfg.Gateway)
+		}
+		if cfg.GatewayIface != "" {
+			fmt.Printf("Gateway interface: %s\n", cfg.GatewayIface)
+		}
+		if cfg.PingCheck {
+			fmt.Printf("Gateway ping check: timeout %s\n", cfg.PingTimeout)
+		}
+		if cfg.InterfaceInclude != "" {
+			fmt.Printf("Adapters included: %s\n", cfg.InterfaceInclude)
+		}
+		if cfg.InterfaceExclude != "" {
+			fmt.Printf("Adapters excluded: %s\n", cfg.InterfaceExclude)
+		}
+	}
+	if cfg.Mode == "user" || cfg.Mode == "both" {
+		if cfg.FullUserName != "" {
+			fmt.Printf("Full username: %s\n", cfg.FullUserName)
+		}
+		if cfg.FindUserName != "" {
+			fmt.Printf("Find username: %s\n", cfg.FindUserName)
+		}
+		if cfg.NameRegex != "" {
+			fmt.Printf("Username regex: %s\n", cfg.NameRegex)
+		}
+	}
+	if (cfg.Mode == "group" || cfg.Mode == "both") && cfg.Group != "" {
+		fmt.Printf("Group: %s\n", cfg.Group)
+	}
+	if (cfg.Mode == "sid" || cfg.Mode == "both") && cfg.SID != "" {
+		fmt.Printf("User SID: %s\n", cfg.SID)
+	}
+	if (cfg.Mode == "ssid" || cfg.Mode == "both") && cfg.SSID != "" {
+		fmt.Printf("SSID: %s\n", cfg.SSID)
+	}
+	if (cfg.Mode == "dnssuffix" || cfg.Mode == "both") && cfg.DNSSuffix != "" {
+		fmt.Printf("DNS suffix: %s\n", cfg.DNSSuffix)
+	}
+	if (cfg.Mode == "dns" || cfg.Mode == "both") && cfg.DNSServer != "" {
+		fmt.Printf("DNS server: %s\n", cfg.DNSServer)
+	}
+	if (cfg.Mode == "reachable" || cfg.Mode == "both") && cfg.Probe != "" {
+		fmt.Printf("Probe: %s (timeout %s)\n", cfg.Probe, cfg.ProbeTimeout)
+	}
+	if (cfg.Mode == "gatewaymac" || cfg.Mode == "both") && cfg.GatewayMAC != "" {
+		fmt.Printf("Gateway MAC: %s\n", cfg.GatewayMAC)
+	}
+	if cfg.Mode == "hostname" {
+		fmt.Printf("Computer name: %s\n", orDefault(cfg.Hostname, "-"))
+		fmt.Printf("Computer name contains: %s\n", orDefault(cfg.HostnameFind, "-"))
+	}
+	if cfg.Mode == "dhcpoption" {
+		fmt.Printf("DHCP option: %d = %s\n", cfg.DHCPOption, cfg.DHCPValue)
+	}
+	if cfg.Mode == "script" {
+		fmt.Printf("Check command: %s (timeout %s)\n", cfg.CheckCommand, cfg.CheckTimeout)
+	}
+	if cfg.Mode == "vpn" || cfg.VPNForcesOn {
+		fmt.Printf("VPN pattern: %s\n", orDefault(cfg.VPNPattern, proxy.DefaultVPNPattern))
+		if cfg.VPNForcesOn {
+			fmt.Println("VPN forces the proxy on")
+		}
+	}
+	fmt.Printf("Proxy server: %s\n", cfg.MaskedProxyServer())
+	fmt.Printf("Proxy override: %s\n", cfg.ProxyOverride())
+	if cfg.Invert {
+		fmt.Println("Inverted logic: proxy is ENABLED when conditions are NOT met")
+	}
+	if cfg.HasSchedule() {
+		fmt.Printf("Schedule: hours %s, days %s\n", orDefault(cfg.Hours, "any"), orDefault(cfg.Days, "any"))
+	}
+	fmt.Println("")
+
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Println("Checking conditions...")
+
+	currentUser, err := cfg.UserSource().CurrentUsername()
+	if err != nil {
+		fmt.Printf("Error getting username: %v\n", err)
+	} else {
+		fmt.Printf("Current username: %s\n", currentUser)
+	}
+
+	decision, err := cfg.Evaluate()
+	if err != nil {
+		fmt.Printf("Error checking conditions: %v\n", err)
+		return
+	}
+
+	// Сообщение о выполнении условий показывается до инверсии
+	conditionsMet := decision.Enable != cfg.Invert
+	if conditionsMet {
+		fmt.Printf("✓ Conditions met (%s)\n", decision.Reason)
+	} else {
+		fmt.Printf("✗ Conditions not met (%s)\n", decision.Reason)
+	}
+	if cfg.Invert {
+		fmt.Println("Inverted logic applied")
+	}
+	if decision.Enable {
+		fmt.Println("Result: WOULD ENABLE PROXY")
+	} else {
+		fmt.Println("Result: WOULD DISABLE PROXY")
+	}
+
+	fmt.Println("")
+
+	enabled, server, err := cfg.CurrentSettings()
+	if err != nil {
+		fmt.Printf("Error reading current proxy settings: %v\n", err)
+	} else {
+		status := "DISABLED"
+		if enabled {
+			status = "ENABLED"
+		}
+		fmt.Printf("Current proxy settings: %s (%s)\n", status, proxy.MaskCredentials(server))
+	}
+	for _, location := range proxy.PolicyLocations() {
+		fmt.Printf("Warning: proxy is enforced by policy in %s, HKCU changes are ignored (see --gpo)\n", location.Name)
+	}
+
+	fmt.Println("")
+	fmt.Println("Note: This is a test. No changes were made to system settings.")
+	fmt.Println("Use --install to install the service for actual operation.")
+}
+
+func gatewayMatchMark(gateway string) string {
+	sites, _ := cfg.Sites()
+	for _, site := range sites {
+		if !proxy.GatewayMatches(site.Gateway, gateway) {
+			continue
+		}
+		if site.Label != "" {
+			return "✓ matches site " + site.Label
+		}
+		return "✓ matches --gateway"
+	}
+	return "✗"
+}
+
+// listGateways показывает, что видит определение шлюза: маршруты по
+// умолчанию, адаптеры и шлюзы (через iphlpapi, route/netsh - запасной путь)
+func listGateways() {
+	fmt.Println("=== ESPD Proxy Service Gateways ===")
+	if cfg.GatewaySites != "" {
+		fmt.Printf("Configured gateway sites: %s\n", cfg.GatewaySites)
+	} else {
+		fmt.Printf("Configured gateway: %s\n", cfg.Gateway)
+	}
+	fmt.Println("")
+
+	// Через источник cfg, чтобы учитывать --simulate-gateway
+	gatewaySource := cfg.GatewaySource()
+	adapters, adaptersErr := gatewaySource.AdapterGateways()
+	adapterName := func(address string) string {
+		for _, adapter := range adapters {
+			for _, addr := range adapter.Addresses {
+				if addr == address {
+					return adapter.Name
+				}
+			}
+		}
+		return address
+	}
+
+	// Таблица маршрутов не подставляется, с --simulate-gateway её нет смысла показывать
+	if simulateGW == "" {
+		fmt.Println("Default routes (GetIpForwardTable, route print as fallback):")
+		routes, err := proxy.DefaultRoutes()
+		if err != nil {
+			fmt.Printf("  Error: %v\n", err)
+		}
+		for _, route := range routes {
+			fmt.Printf("  %-15s interface %s, metric %d  %s\n",
+				route.Gateway, adapterName(route.Interface), route.Metric, gatewayMatchMark(route.Gateway))
+		}
+	}
+
+	if gateway, err := gatewaySource.DefaultGateway(); err != nil {
+		fmt.Printf("Default gateway: not found (%v)\n", err)
+	} else {
+		fmt.Printf("Default gateway: %s\n", gateway)
+	}
+	fmt.Println("")
+
+	fmt.Println("Adapters (GetAdaptersAddresses):")
+	if adaptersErr != nil {
+		fmt.Printf("  Error: %v\n", adaptersErr)
+	}
+	for _, adapter := range adapters {
+		if len(adapter.Gateways) == 0 {
+			continue
+		}
+		fmt.Printf("  %s (%s), index %d, metric %d\n", adapter.Name, adapter.Description, adapter.Index, adapter.Metric)
+		for _, gateway := range adapter.Gateways {
+			fmt.Printf("    %-15s %s\n", gateway, gatewayMatchMark(gateway))
+		}
+	}
+	fmt.Println("")
+
+	fmt.Println("Active gateways (GetAdaptersAddresses, netsh as fallback):")
+	gateways, err := gatewaySource.ActiveGateways()
+	if err != nil {
+		fmt.Printf("  Error: %v\n", err)
+	}
+	for _, gateway := range gateways {
+		fmt.Printf("  %-15s %s\n", gateway, gatewayMatchMark(gateway))
+	}
+}
+
+// whoami показывает имя пользователя во всех формах, которые встречаются
+// в настройках, и проверяет каждую по --fullname/--findname/--nameregex
+func whoami() {
+	fmt.Println("=== ESPD Proxy Service User ===")
+	if cfg.FullUserName != "" {
+		fmt.Printf("Full username: %s\n", cfg.FullUserName)
+	}
+	if cfg.FindUserName != "" {
+		fmt.Printf("Find username: %s\n", cfg.FindUserName)
+	}
+	if cfg.NameRegex != "" {
+		fmt.Printf("Username regex: %s\n", cfg.NameRegex)
+	}
+	fmt.Println("")
+
+	show := func(label, name string, err error) {
+		if err != nil {
+			fmt.Printf("%-28s not available (%v)\n", label+":", err)
+			return
+		}
+		if matched, rule := cfg.MatchUsername(name); matched {
+			fmt.Printf("%-28s %s  ✓ matches %s\n", label+":", name, rule)
+		} else {
+			fmt.Printf("%-28s %s  ✗ no match\n", label+":", name)
+		}
+	}
+
+	// Через источник cfg, чтобы учитывать --simulate-user. У подставленного
+	// пользователя нет SAM-имени, а UPN и SID есть, только если он задан в этой форме
+	users := cfg.UserSource()
+	name, err := users.CurrentUsername()
+	show("Current username", name, err)
+	if simulateUser == "" {
+		name, err = proxy.UserNameEx(windows.NameSamCompatible)
+		show("SAM-compatible name", name, err)
+	}
+	if name, err = users.UserPrincipalName(); err != nil || name != "" {
+		show("User principal name (UPN)", name, err)
+	}
+
+	// SID выводится отдельно: по имени он не сопоставляется
+	if sid, err := users.CurrentUserSID(); err != nil {
+		fmt.Printf("%-28s not available (%v)\n", "User SID:", err)
+	} else if sid != "" {
+		fmt.Printf("%-28s %s\n", "User SID:", sid)
+	}
+}
+
+var serviceStateNames = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "start pending",
+	svc.StopPending:     "stop pending",
+	svc.Running:         "running",
+	svc.ContinuePending: "continue pending",
+	svc.PausePending:    "pause pending",
+	svc.Paused:          "paused",
+}
+
+// effectiveConfig возвращает значения параметров конфигурации со скрытыми секретами
+func effectiveConfig() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] {
+			return
+		}
+		values[f.Name] = f.Value.String()
+		if secretFlags[f.Name] && values[f.Name] != "" {
+			values[f.Name] = "***"
+		}
+	})
+	return values
+}
+
+// testReport - результат --test --json для автоматических проверок развёртывания
+type testReport struct {
+	Mode           string            `json:"mode"`
+	Config         map[string]string `json:"config"`
+	DefaultGateway string            `json:"default_gateway,omitempty"`
+	Gateways       []string          `json:"gateways"`
+	User           string            `json:"user,omitempty"`
+	UPN            string            `json:"upn,omitempty"`
+	Decision       *proxy.Decision   `json:"decision,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	Proxy          testProxyState    `json:"proxy"`
+	Errors         map[string]string `json:"errors,omitempty"`
+}
+
+type testProxyState struct {
+	Enabled  bool   `json:"enabled"`
+	Server   string `json:"server"`
+	Override string `json:"override"`
+}
+
+func testProxySettingJSON() {
+	report := testReport{
+		Mode:   cfg.Mode,
+		Config: effectiveConfig(),
+		Errors: make(map[string]string),
+	}
+
+	var err error
+	// Через источники cfg, чтобы отчёт учитывал --simulate-*
+	if report.DefaultGateway, err = cfg.GatewaySource().DefaultGateway(); err != nil {
+		report.Errors["default_gateway"] = err.Error()
+	}
+	if report.Gateways, err = cfg.GatewaySource().ActiveGateways(); err != nil {
+		report.Errors["gateways"] = err.Error()
+	}
+	if report.User, err = cfg.UserSource().CurrentUsername(); err != nil {
+		report.Errors["user"] = err.Error()
+	}
+	report.UPN, _ = cfg.UserSource().UserPrincipalName()
+
+	if err := cfg.ValidateProxy(); err != nil {
+		report.Error = err.Error()
+	} else if decision, err := cfg.Evaluate(); err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Decision = &decision
+	}
+
+	settings, err := proxy.SettingsValues()
+	if err != nil {
+		report.Errors["proxy"] = err.Error()
+	}
+	report.Proxy = testProxyState{
+		Enabled:  settings["ProxyEnable"] == "1",
+		Server:   proxy.MaskCredentials(settings["ProxyServer"]),
+		Override: settings["ProxyOverride"],
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("{\"error\": %q}\n", err.Error())
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// diagnose собирает в один отчёт всё, что обычно спрашивают в заявке:
+// версию, конфигурацию, шлюзы, имя пользователя, реестр, решение и службу.
+// Пароль прокси скрывается, поэтому отчёт можно вставлять в заявку целиком
+func diagnose() {
+	fmt.Println("=== ESPD Proxy Service Diagnostics ===")
+	fmt.Println(versionString())
+	fmt.Printf("Time: %s\n", time.Now().Format(time.RFC3339))
+	if hostname, err := os.Hostname(); err == nil {
+		fmt.Printf("Computer: %s\n", hostname)
+	}
+	fmt.Println("")
+
+	fmt.Println("=== Effective configuration ===")
+	values := effectiveConfig()
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  --%s=%s\n", name, values[name])
+	}
+	fmt.Println("")
+
+	listGateways()
+	fmt.Println("")
+	whoami()
+	fmt.Println("")
+
+	fmt.Println("=== Proxy registry values (HKCU) ===")
+	settings, err := proxy.SettingsValues()
+	if err != nil {
+		fmt.Printf("  Error: %v\n", err)
+	}
+	for _, name := range []string{"ProxyEnable", "ProxyServer", "ProxyOverride", "AutoConfigURL"} {
+		value, ok := settings[name]
+		if !ok {
+			value = "(not set)"
+		} else if name == "ProxyServer" {
+			value = proxy.MaskCredentials(value)
+		}
+		fmt.Printf("  %-14s %s\n", name+":", value)
+	}
+	fmt.Println("")
+
+	fmt.Println("=== Group Policy ===")
+	if locations := proxy.PolicyLocations(); len(locations) == 0 {
+		fmt.Println("  No policy-enforced proxy settings")
+	} else {
+		for _, location := range locations {
+			fmt.Printf("  Enforced by policy: %s\n", location.Name)
+		}
+	}
+	fmt.Println("")
+
+	fmt.Println("=== Decision ===")
+	if decision, err := cfg.Evaluate(); err != nil {
+		fmt.Printf("  Error: %v\n", err)
+	} else {
+		fmt.Printf("  Enable: %t\n", decision.Enable)
+		fmt.Printf("  Reason: %s\n", decision.Reason)
+	}
+	fmt.Println("")
+
+	fmt.Println("=== Service ===")
+	diagnoseService()
+}
+
+// proxyPassArgPattern находит значение --proxy-pass в командной строке службы
+var proxyPassArgPattern = regexp.MustCompile(`(--proxy-pass=)("[^"]*"|\S+)`)
+
+// diagnoseService показывает состояние службы и результат её последней проверки
+func diagnoseService() {
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("  Service manager not available: %v\n", err)
+		return
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("  %s: not installed\n", serviceName)
+		return
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err != nil {
+		fmt.Printf("  %s: installed, state unknown (%v)\n", serviceName, err)
+	} else {
+		fmt.Printf("  %s: installed, %s\n", serviceName, serviceStateNames[status.State])
+	}
+	if config, err := s.Config(); err == nil {
+		commandLine := proxyPassArgPattern.ReplaceAllString(config.BinaryPathName, "${1}***")
+		fmt.Printf("  Command line: %s\n", proxy.MaskCredentials(commandLine))
+	}
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.QUERY_VALUE)
+	if err != nil {
+		fmt.Printf("  Last check: not recorded\n")
+		return
+	}
+	defer k.Close()
+	for _, name := range []string{"LastCheckTime", "LastResult", "LastError"} {
+		value, _, _ := k.GetStringValue(name)
+		fmt.Printf("  %-14s %s\n", name+":", value)
+	}
+	if killSwitchActive() {
+		fmt.Printf("  %-14s %s\n", "Kill switch:", "set by --disable-now")
+	}
+}
+
+func checkLogFields(proxyState string, decision proxy.Decision) logFields {
+	fields := logFields{
+		"mode":        cfg.Mode,
+		"gateway":     cfg.Gateway,
+		"proxy":       cfg.MaskedProxyServer(),
+		"proxy_state": proxyState,
+		"reason":      decision.Reason,
+	}
+	if decision.Site != "" {
+		fields["site"] = decision.Site
+	}
+	return fields
+}
+
+// serviceState хранит результат последней проверки для /status
+type serviceState struct {
+	mu           sync.Mutex
+	LastCheck    time.Time
+	Decision     proxy.Decision
+	ProxyEnabled bool
+	LastError    string
+	Panics       int
+	Checks       int
+	ApplyErrors  int
+	Drifts       int
+}
+
+var state serviceState
+
+func (st *serviceState) update(decision proxy.Decision, enabled bool, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.LastCheck = time.Now()
+	st.Decision = decision
+	st.ProxyEnabled = enabled
+	st.Checks++
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+		var regErr *registryError
+		if errors.As(err, &regErr) {
+			st.ApplyErrors++
+		}
+	}
+}
+
+// lastResult возвращает состояние прокси по предыдущей проверке и было ли она
+func (st *serviceState) lastResult() (bool, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ProxyEnabled, st.Checks > 0
+}
+
+func (st *serviceState) recordDrift() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Drifts++
+}
+
+func (st *serviceState) recordPanic(value interface{}) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Panics++
+	st.LastCheck = time.Now()
+	st.LastError = fmt.Sprintf("panic: %v", value)
+	return st.Panics
+}
+
+// registryError отличает ошибки записи в реестр от ошибок проверки условий
+type registryError struct {
+	err error
+}
+
+func (e *registryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryError) Unwrap() error {
+	return e.err
+}
+
+// checkAndSetProxy проверяет условия и применяет настройки прокси.
+// Возвращает итоговое состояние прокси (для --apply)
+func checkAndSetProxy(debounce *stateDebouncer, cooldown *applyCooldown) (bool, error) {
+	decision, enabled, err := applyProxyDecision(debounce, cooldown)
+	state.update(decision, enabled, err)
+	writeStatusKey(enabled, err)
+	return enabled, err
+}
+
+// writeStatusKey сохраняет результат последней проверки в HKLM для систем
+// мониторинга, которые читают реестр, но не лог и не HTTP. Без прав
+// администратора (--apply от пользователя) запись пропускается
+func writeStatusKey(enabled bool, checkErr error) {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		logDebug(fmt.Sprintf("Cannot open status key HKLM\\%s: %v", statusKeyPath(), err))
+		return
+	}
+	defer k.Close()
+
+	lastError := ""
+	if checkErr != nil {
+		lastError = checkErr.Error()
+	}
+
+	values := map[string]string{
+		"LastCheckTime": time.Now().Format(time.RFC3339),
+		"LastResult":    proxyStateName(enabled),
+		"LastError":     lastError,
+	}
+	for name, value := range values {
+		if err := k.SetStringValue(name, value); err != nil {
+			logDebug(fmt.Sprintf("Cannot write status value %s: %v", name, err))
+			return
+		}
+	}
+}
+
+// writtenSettingsNames - значения, которые служба записала последней, в ключе
+// состояния. Пароль в ProxyServer хранится скрытым
+var writtenSettingsNames = []string{"ProxyEnable", "ProxyServer", "ProxyOverride"}
+
+// recordWrittenSettings запоминает значения прокси, записанные в HKCU
+func recordWrittenSettings() {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		logDebug(fmt.Sprintf("Cannot open status key HKLM\\%s: %v", statusKeyPath(), err))
+		return
+	}
+	defer k.Close()
+
+	values, err := proxy.SettingsValues()
+	if err != nil {
+		return
+	}
+	for _, name := range writtenSettingsNames {
+		value := values[name]
+		if name == "ProxyServer" {
+			value = proxy.MaskCredentials(value)
+		}
+		if err := k.SetStringValue("Written"+name, value); err != nil {
+			logDebug(fmt.Sprintf("Cannot write status value Written%s: %v", name, err))
+			return
+		}
+	}
+}
+
+// externalChanges сравнивает текущие значения прокси с последними записанными
+// службой и возвращает изменённые другими программами
+func externalChanges() []string {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer k.Close()
+
+	current, err := proxy.SettingsValues()
+	if err != nil {
+		return nil
+	}
+
+	var changed []string
+	for _, name := range writtenSettingsNames {
+		written, _, err := k.GetStringValue("Written" + name)
+		if err != nil {
+			// Служба ещё ничего не записывала
+			return nil
+		}
+		value := current[name]
+		if name == "ProxyServer" {
+			value = proxy.MaskCredentials(value)
+		}
+		if value != written {
+			changed = append(changed, fmt.Sprintf("%s %q -> %q", name, written, value))
+		}
+	}
+	return changed
+}
+
+// safeCheckAndSetProxy перехватывает панику в проверке, чтобы одна ошибка
+// не останавливала цикл службы, которая для SCM продолжает быть Running
+func safeCheckAndSetProxy(debounce *stateDebouncer, cooldown *applyCooldown) (enabled bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			count := state.recordPanic(r)
+			logError(fmt.Sprintf("Panic during check (%d since start): %v\n%s", count, r, debug.Stack()))
+		}
+	}()
+	enabled, _ = checkAndSetProxy(debounce, cooldown)
+	return enabled
+}
+
+// stateDebouncer подавляет дребезг: новое состояние применяется только после
+// required подряд совпадающих проверок. Первая проверка применяется сразу
+type stateDebouncer struct {
+	required  int
+	confirmed bool
+	hasState  bool
+	pending   bool
+	count     int
+}
+
+func newStateDebouncer(required int) *stateDebouncer {
+	if required < 1 {
+		required = 1
+	}
+	return &stateDebouncer{required: required}
+}
+
+// observe возвращает состояние, которое нужно применить
+func (d *stateDebouncer) observe(desired bool) bool {
+	if !d.hasState || desired == d.confirmed {
+		d.confirmed = desired
+		d.hasState = true
+		d.count = 0
+		return desired
+	}
+
+	if d.count > 0 && desired == d.pending {
+		d.count++
+	} else {
+		d.pending = desired
+		d.count = 1
+	}
+
+	if d.count >= d.required {
+		d.confirmed = desired
+		d.count = 0
+		return desired
+	}
+
+	logInfo(fmt.Sprintf("State change pending confirmation (%d/%d), keeping proxy %s",
+		d.count, d.required, proxyStateName(d.confirmed)))
+	return d.confirmed
+}
+
+// idleChecksBeforeBackoff - сколько проверок подряд с тем же результатом
+// нужно, чтобы интервал удвоился
+const idleChecksBeforeBackoff = 3
+
+// adaptiveInterval удлиняет интервал периодических проверок (--max-interval),
+// пока результат не меняется: после idleChecksBeforeBackoff одинаковых
+// проверок он удваивается, но не выше max. Смена состояния или событие сети
+// возвращают базовый интервал
+type adaptiveInterval struct {
+	base, max, current time.Duration
+	enabled, hasState  bool
+	idle               int
+}
+
+func newAdaptiveInterval(base, limit time.Duration) *adaptiveInterval {
+	return &adaptiveInterval{base: base, max: limit, current: base}
+}
+
+// observe учитывает результат проверки и возвращает следующий интервал
+func (a *adaptiveInterval) observe(enabled bool) time.Duration {
+	if a.hasState && enabled != a.enabled {
+		a.enabled = enabled
+		a.reset("proxy state changed")
+		return a.current
+	}
+	a.enabled, a.hasState = enabled, true
+
+	if a.max <= a.base {
+		return a.current
+	}
+	a.idle++
+	if a.idle >= idleChecksBeforeBackoff && a.current < a.max {
+		a.idle = 0
+		a.current = min(2*a.current, a.max)
+		logDebug(fmt.Sprintf("No changes, check interval increased to %s", a.current))
+	}
+	return a.current
+}
+
+func (a *adaptiveInterval) reset(reason string) {
+	a.idle = 0
+	if a.current != a.base {
+		a.current = a.base
+		logDebug(fmt.Sprintf("Check interval reset to %s (%s)", a.base, reason))
+	}
+}
+
+// longestInterval - наибольший возможный промежуток между проверками
+func longestInterval() time.Duration {
+	return max(checkInterval, maxInterval)
+}
+
+func validateIntervals() error {
+	if checkInterval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	if maxInterval != 0 && maxInterval < checkInterval {
+		return fmt.Errorf("--max-interval %s is shorter than --interval %s", maxInterval, checkInterval)
+	}
+	return nil
+}
+
+// auditSettings сравнивает желаемое состояние прокси с фактическим у каждого
+// пользователя (--audit). В отличие от --dryrun, отчёт пишется на каждой
+// проверке, а расхождение - предупреждение в журнале событий
+func auditSettings(desired bool, decision proxy.Decision) {
+	users, err := cfg.AllCurrentSettings()
+	if err != nil {
+		logWarn(fmt.Sprintf("Audit: cannot read current proxy settings: %v", err))
+		return
+	}
+	if len(users) == 0 {
+		logDebug("Audit: no active user sessions")
+		return
+	}
+
+	// При --all-sessions с условиями на пользователя решение у каждого своё
+	sessions := make(map[string]proxy.SessionDecision)
+	for _, session := range decision.Sessions {
+		sessions[session.SID] = session
+	}
+
+	drift := false
+	for _, user := range users {
+		userDesired, reason := desired, decision.Reason
+		if session, ok := sessions[user.SID]; ok {
+			userDesired, reason = desired && session.Enable, session.Reason
+		}
+		actual := user.Enabled && cfg.OwnsServer(user.Server)
+		fields := logFields{
+			"location": user.Location,
+			"desired":  proxyStateName(userDesired),
+			"actual":   proxyStateName(actual),
+			"server":   proxy.MaskCredentials(user.Server),
+			"reason":   reason,
+		}
+		if actual == userDesired {
+			logWithFields(levelInfo, fmt.Sprintf("Audit: %s proxy %s as desired", user.Location, proxyStateName(actual)), fields)
+			continue
+		}
+
+		drift = true
+		message := fmt.Sprintf("Audit: proxy drift at %s: desired %s, actual %s (ProxyEnable=%t, ProxyServer=%s)",
+			user.Location, proxyStateName(userDesired), proxyStateName(actual), user.Enabled, proxy.MaskCredentials(user.Server))
+		logWithFields(levelWarn, message, fields)
+		if eventLog != nil {
+			eventLog.Warning(1, message)
+		}
+	}
+	if drift {
+		state.recordDrift()
+	}
+}
+
+// applyCooldown ограничивает частоту смены состояния прокси (--min-apply-interval).
+// Повторная запись того же состояния не ограничивается. Отложенное изменение
+// применяется повторной проверкой, когда интервал истечёт, поэтому
+// применяется последнее желаемое состояние, а не то, что было отложено
+type applyCooldown struct {
+	interval   time.Duration
+	lastChange time.Time
+	pending    bool
+	ready      chan struct{}
+}
+
+func newApplyCooldown(interval time.Duration) *applyCooldown {
+	return &applyCooldown{interval: interval, ready: make(chan struct{}, 1)}
+}
+
+// allow сообщает, можно ли менять состояние сейчас, и иначе планирует повторную проверку
+func (c *applyCooldown) allow() bool {
+	if c == nil || c.interval <= 0 || c.lastChange.IsZero() {
+		return true
+	}
+
+	wait := c.interval - time.Since(c.lastChange)
+	if wait <= 0 {
+		return true
+	}
+
+	logInfo(fmt.Sprintf("Proxy change deferred for %s (--min-apply-interval)", wait.Round(time.Second)))
+	if !c.pending {
+		c.pending = true
+		time.AfterFunc(wait, func() {
+			c.ready <- struct{}{}
+		})
+	}
+	return false
+}
+
+func (c *applyCooldown) changed() {
+	if c != nil {
+		c.lastChange = time.Now()
+	}
+}
+
+func proxyStateName(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func applyProxyDecision(debounce *stateDebouncer, cooldown *applyCooldown) (proxy.Decision, bool, error) {
+	// При ошибке проверки состояние не меняется
+	decision, err := cfg.Evaluate()
+	if err != nil {
+		logError(fmt.Sprintf("Error checking conditions: %v", err))
+		return decision, false, err
+	}
+
+	shouldEnable := decision.Enable
+	if debounce != nil {
+		shouldEnable = debounce.observe(decision.Enable)
+	}
+
+	logDebug(fmt.Sprintf("Configuration: mode=%s, gateway=%s, fullname=%s, findname=%s, group=%s, proxy=%s",
+		cfg.Mode, cfg.Gateway, cfg.FullUserName, cfg.FindUserName, cfg.Group, cfg.MaskedProxyServer()))
+	logWithFields(levelDebug, "Decision: "+decision.Reason, logFields{
+		"enable":          strconv.FormatBool(decision.Enable),
+		"gateway_matched": strconv.FormatBool(decision.GatewayMatched),
+		"user_matched":    strconv.FormatBool(decision.UserMatched),
+	})
+
+	// Аварийное выключение (--disable-now) действует до --enable-now
+	if killSwitchActive() {
+		logDebug("Proxy kept disabled by --disable-now")
+		shouldEnable = false
+		decision.Enable = false
+		decision.Reason = "disabled with --disable-now"
+	}
+
+	if auditMode {
+		auditSettings(shouldEnable, decision)
+		return decision, shouldEnable, nil
+	}
+
+	// Восстановленный собственный прокси пользователя нашим включением не считается,
+	// а переключение между резервными адресами --proxy - считается
+	wasEnabled, currentServer, err := cfg.CurrentSettings()
+	if err != nil {
+		logWarn(fmt.Sprintf("Error reading current proxy settings: %v", err))
+	}
+	wasEnabled = wasEnabled && cfg.OwnsServer(currentServer)
+	if cfg.ServerOnly {
+		// ProxyEnable не наш: "включён" - значит, записан наш адрес
+		wasEnabled = cfg.OwnsServer(currentServer)
+	}
+	changed := shouldEnable != wasEnabled
+
+	// В режиме dryrun реестр не изменяется, только пишется лог. Реестр
+	// остаётся прежним, поэтому сменой считается смена решения
+	if dryRun {
+		previous, checked := state.lastResult()
+		changed = !checked || previous != shouldEnable
+		if shouldEnable {
+			logChange(changed, "Conditions met, WOULD enable proxy (dry run)", checkLogFields("enabled", decision))
+		} else {
+			logChange(changed, "Conditions not met, WOULD disable proxy (dry run)", checkLogFields("disabled", decision))
+		}
+		return decision, shouldEnable, nil
+	}
+
+	if changed && !cooldown.allow() {
+		return decision, wasEnabled, nil
+	}
+
+	if shouldEnable {
+		logDebug("Conditions met, enabling proxy")
+		// Настройки в HKCU текущей учётной записи; при AllSessions их
+		// пишет служба в кусты пользователей, сравнивать не с чем
+		if !cfg.AllSessions {
+			if changed := externalChanges(); len(changed) > 0 {
+				logWarn(fmt.Sprintf("Proxy settings were changed externally (%s), reapplying", strings.Join(changed, ", ")))
+			}
+		}
+		err := cfg.SetProxy(true)
+		if err != nil {
+			logError(fmt.Sprintf("Error enabling proxy: %v", err))
+			return decision, wasEnabled, &registryError{err}
+		}
+		if !cfg.AllSessions {
+			recordWrittenSettings()
+		}
+		if decision.Site != "" {
+			logChange(changed, "Proxy enabled for site "+decision.Site, checkLogFields("enabled", decision))
+		} else {
+			logChange(changed, "Proxy enabled successfully", checkLogFields("enabled", decision))
+		}
+		if verifyProxy {
+			verifyProxyReachable()
+		}
+		if !wasEnabled {
+			cooldown.changed()
+			sendNotification("ESPD proxy enabled")
+		}
+	} else {
+		logDebug("Conditions not met, disabling proxy")
+		err := cfg.SetProxy(false)
+		if err != nil {
+			logError(fmt.Sprintf("Error disabling proxy: %v", err))
+			return decision, wasEnabled, &registryError{err}
+		}
+		if !cfg.AllSessions {
+			recordWrittenSettings()
+		}
+		logChange(changed, "Proxy disabled successfully", checkLogFields("disabled", decision))
+		if wasEnabled {
+			cooldown.changed()
+			sendRetryNotification("ESPD proxy disabled: " + decision.Reason)
+		}
+	}
+
+	return decision, shouldEnable, nil
+}
+
+// verifyProxyReachable проверяет TCP-подключение к включённому прокси, чтобы
+// в логе было видно "прокси включён, но недоступен"
+func verifyProxyReachable() {
+	for _, addr := range cfg.ProxyAddresses() {
+		conn, err := net.DialTimeout("tcp", addr, verifyProxyTimeout)
+		if err != nil {
+			logWarn(fmt.Sprintf("Proxy enabled but unreachable: %s: %v", addr, err))
+			continue
+		}
+		conn.Close()
+		logDebug(fmt.Sprintf("Proxy %s is reachable", addr))
+	}
+}
+
+const (
+	mbRetryCancel     = 0x05
+	mbIconInformation = 0x40
+	idRetry           = 4
+)
+
+// recheckRequests получает нажатие "Повтор" в уведомлении о выключении прокси
+var (
+	recheckRequests = make(chan struct{}, 1)
+	retryDialogOpen atomic.Bool
+)
+
+// wtsSendMessage показывает окно в активной консольной сессии и при wait
+// возвращает нажатую кнопку. Служба работает в сессии 0 и не может показать
+// всплывающее уведомление (toast) сама: для него нужен процесс в сессии
+// пользователя с AppUserModelID и COM-активатором, поэтому используется
+// WTSSendMessage - окно сообщения поверх рабочего стола
+func wtsSendMessage(message string, style, timeout uint32, wait bool) (uint32, bool) {
+	sessionID := windows.WTSGetActiveConsoleSessionId()
+	if sessionID == 0xFFFFFFFF {
+		logDebug("No active console session, notification skipped")
+		return 0, false
+	}
+
+	title, _ := windows.UTF16FromString(serviceDescription)
+	text, _ := windows.UTF16FromString(message)
+
+	var waitFlag uintptr
+	if wait {
+		waitFlag = 1
+	}
+	var response uint32
+	ret, _, err := procWTSSendMessage.Call(
+		0, // WTS_CURRENT_SERVER_HANDLE
+		uintptr(sessionID),
+		uintptr(unsafe.Pointer(&title[0])), uintptr((len(title)-1)*2),
+		uintptr(unsafe.Pointer(&text[0])), uintptr((len(text)-1)*2),
+		uintptr(style), uintptr(timeout),
+		uintptr(unsafe.Pointer(&response)),
+		waitFlag,
+	)
+	if ret == 0 {
+		logWarn(fmt.Sprintf("Failed to send notification to session %d: %v", sessionID, err))
+		return 0, false
+	}
+
+	logDebug(fmt.Sprintf("Notification sent to session %d: %s", sessionID, message))
+	return response, true
+}
+
+// sendNotification показывает сообщение без ожидания ответа
+func sendNotification(message string) {
+	if !notifyUser {
+		return
+	}
+	const notificationTimeout = 10
+	wtsSendMessage(message, mbIconInformation, notificationTimeout, false)
+}
+
+// sendRetryNotification показывает сообщение с кнопкой "Повтор", которая
+// запускает немедленную проверку - как --check-now, но из сессии
+// пользователя, без прав администратора. Окно ждёт ответа в отдельной
+// горутине; одновременно открыто не больше одного
+func sendRetryNotification(message string) {
+	if !notifyUser || !retryDialogOpen.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer retryDialogOpen.Store(false)
+
+		const retryTimeout = 120
+		text := message + "\n\nPress Retry to check again, e.g. after connecting to the ESPD network."
+		response, ok := wtsSendMessage(text, mbRetryCancel|mbIconInformation, retryTimeout, true)
+		if !ok || response != idRetry {
+			return
+		}
+		select {
+		case recheckRequests <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// watchNetworkChanges вызывает синхронные NotifyAddrChange/NotifyRouteChange
+// (без OVERLAPPED они блокируются до изменения) и сообщает о событиях в канал
+func watchNetworkChanges(changes chan<- string) {
+	watch := func(name string, proc *windows.LazyProc) {
+		if err := proc.Find(); err != nil {
+			logWarn(fmt.Sprintf("%s is not available: %v", name, err))
+			return
+		}
+		for {
+			ret, _, _ := proc.Call(0, 0)
+			if ret != 0 {
+				logWarn(fmt.Sprintf("%s failed with code %d, network change notifications disabled", name, ret))
+				return
+			}
+			select {
+			case changes <- name:
+			default:
+			}
+		}
+	}
+
+	go watch("NotifyAddrChange", procNotifyAddrChange)
+	go watch("NotifyRouteChange", procNotifyRouteChange)
+}
+
+// drainNetworkChanges ждёт, пока сеть успокоится, и отбрасывает
+// накопившиеся уведомления, чтобы пачка событий дала одну проверку
+func drainNetworkChanges(changes <-chan string) {
+	time.Sleep(networkSettleDelay)
+	for {
+		select {
+		case <-changes:
+		default:
+			return
+		}
+	}
+}
+
+// applyOnce однократно применяет настройки без установки службы
+// и возвращает код завершения для сценариев входа в систему
+func applyOnce() int {
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitBadArgs
+	}
+	if (cfg.WinHTTP || cfg.GPO || cfg.DotNet) && !checkElevated() {
+		return exitNotElevated
+	}
+
+	if logFileFlag {
+		if err := initLogger(); err != nil {
+			fmt.Printf("Failed to initialize logger: %v\n", err)
+		} else {
+			defer closeLog()
+		}
+	}
+
+	logInfo(versionString())
+	logInfo("ESPD Proxy one-shot apply started")
+
+	// Ctrl+C не прерывает запись в реестр на середине: проверка
+	// завершается, и процесс выходит обычным путём с закрытием лога
+	stop := consoleStop("one-shot apply")
+	defer signal.Reset(os.Interrupt, syscall.SIGTERM)
+
+	enabled, err := checkAndSetProxy(nil, nil)
+	select {
+	case <-stop:
+		logInfo("Check finished after interrupt, exiting")
+	default:
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		var regErr *registryError
+		if errors.As(err, &regErr) {
+			return exitRegistryError
+		}
+		return exitError
+	}
+
+	if enabled {
+		fmt.Println("Proxy enabled")
+		return exitOK
+	}
+	fmt.Println("Proxy disabled")
+	return exitProxyDisabled
+}
+
+// onceAndWatch - режим для сценария входа: работает в сеансе пользователя,
+// поэтому пишет в его собственный HKCU, сразу применяет настройки и следит
+// за сменой сети так же, как служба. При выходе из системы Windows шлёт
+// консольным процессам CTRL_LOGOFF_EVENT, который Go передаёт как SIGTERM
+func onceAndWatch() int {
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitBadArgs
+	}
+	if (cfg.WinHTTP || cfg.GPO || cfg.DotNet) && !checkElevated() {
+		return exitNotElevated
+	}
+
+	if logFileFlag {
+		if err := initLogger(); err != nil {
+			fmt.Printf("Failed to initialize logger: %v\n", err)
+		} else {
+			defer closeLog()
+		}
+	}
+
+	logInfo(versionString())
+	logInfo("ESPD Proxy session watcher started")
+
+	serviceLoop(consoleStop("session watcher"), nil)
+
+	logInfo("ESPD Proxy session watcher stopped")
+	return exitOK
+}
+
+// startStatusServer запускает HTTP-сервер /healthz, /status и /metrics.
+// Адрес без хоста (":8085") привязывается только к localhost
+func startStatusServer() *http.Server {
+	if listenAddr == "" {
+		return nil
+	}
+
+	addr := listenAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		lastCheck := state.LastCheck
+		state.mu.Unlock()
+
+		// Цикл считается живым, если проверка была не позже двух интервалов назад
+		if time.Since(lastCheck) > 2*longestInterval() {
+			http.Error(w, "service loop stalled", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", writeMetrics)
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		status := map[string]interface{}{
+			"version":       version,
+			"last_check":    state.LastCheck,
+			"decision":      state.Decision,
+			"proxy_enabled": state.ProxyEnabled,
+			"last_error":    state.LastError,
+			"panics":        state.Panics,
+			"config": map[string]string{
+				"mode":     cfg.Mode,
+				"gateway":  cfg.Gateway,
+				"fullname": cfg.FullUserName,
+				"findname": cfg.FindUserName,
+				"group":    cfg.Group,
+				"proxy":    cfg.MaskedProxyServer(),
+				"override": cfg.ProxyOverride(),
+			},
+		}
+		state.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logError(fmt.Sprintf("Status server failed: %v", err))
+		}
+	}()
+
+	logInfo(fmt.Sprintf("Status server listening on %s", addr))
+	return server
+}
+
+// writeMetrics отдаёт состояние в текстовом формате Prometheus
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	state.mu.Lock()
+	checks, applyErrors, panics, drifts := state.Checks, state.ApplyErrors, state.Panics, state.Drifts
+	enabled, lastCheck := state.ProxyEnabled, state.LastCheck
+	state.mu.Unlock()
+
+	gauge := 0
+	if enabled {
+		gauge = 1
+	}
+	var timestamp float64
+	if !lastCheck.IsZero() {
+		timestamp = float64(lastCheck.UnixNano()) / 1e9
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"espd_checks_total", "counter", "Condition checks performed since start.", checks},
+		{"espd_apply_errors_total", "counter", "Failed attempts to write proxy settings.", applyErrors},
+		{"espd_check_panics_total", "counter", "Checks aborted by a panic.", panics},
+		{"espd_drift_checks_total", "counter", "Checks in --audit mode that found settings differing from the desired state.", drifts},
+		{"espd_proxy_enabled", "gauge", "Whether the proxy is currently enabled (1) or not (0).", gauge},
+		{"espd_last_check_timestamp_seconds", "gauge", "Unix time of the last check.", timestamp},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		if m.name == "espd_proxy_enabled" {
+			fmt.Fprintf(w, "%s{mode=%q,profile=%q} %v\n", m.name, cfg.Mode, profileName, m.value)
+			continue
+		}
+		fmt.Fprintf(w, "%s %v\n", m.name, m.value)
+	}
+}
+
+func stopStatusServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarn(fmt.Sprintf("Status server shutdown failed: %v", err))
+	}
+}
+
+// serviceHandler обрабатывает команды SCM, чтобы служба корректно
+// сообщала о запуске и останавливалась по команде Stop
+type serviceHandler struct{}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	checkNow := make(chan struct{}, 1)
+	go func() {
+		serviceLoop(stop, checkNow)
+		close(done)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			close(stop)
+			<-done
+			return false, 0
+		case checkNowControl:
+			// Повторные запросы до начала проверки объединяются в один
+			select {
+			case checkNow <- struct{}{}:
+			default:
+			}
+			status <- request.CurrentStatus
+		}
+	}
+
+	return false, 0
+}
+
+// setSessionRefreshCommand при --all-sessions задаёт команду, которой
+// сеансы пользователей узнают о смене настроек (см. --refresh-session)
+func setSessionRefreshCommand() {
+	if !cfg.AllSessions {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		logWarn(fmt.Sprintf("Cannot locate the executable, user sessions will not be notified of proxy changes: %v", err))
+		return
+	}
+	cfg.SessionRefreshCommand = []string{exe, "--refresh-session"}
+	if cfg.NoRefresh {
+		cfg.SessionRefreshCommand = append(cfg.SessionRefreshCommand, "--no-refresh")
+	}
+}
+
+func runService() {
+	if logFileFlag {
+		err := initLogger()
+		if err != nil {
+			log.Fatalf("Failed to initialize logger: %v", err)
+		}
+		defer closeLog()
+	}
+
+	if err := initEventLog(); err != nil {
+		logWarn(fmt.Sprintf("Failed to open event log: %v", err))
+	} else {
+		defer eventLog.Close()
+	}
+
+	logInfo(versionString())
+	logEvent("ESPD Proxy Service started", nil)
+	if passStored {
+		if password, err := loadProxyPassword(); err != nil {
+			logError(fmt.Sprintf("Cannot read the proxy password from HKLM\\%s: %v", credentialsKeyPath(), err))
+		} else {
+			cfg.ProxyPassword = password
+		}
+	}
+	if simulateGW != "" || simulateUser != "" {
+		if dryRun {
+			logWarn(fmt.Sprintf("Dry run with simulated gateway %q and user %q", simulateGW, simulateUser))
+		} else {
+			logWarn("--simulate-gateway and --simulate-user are ignored in service mode without --dryrun")
+		}
+	}
+	setSessionRefreshCommand()
+	logInfo(fmt.Sprintf("Service configuration: mode=%s, gateway=%s, fullname=%s, findname=%s, group=%s, proxy=%s",
+		cfg.Mode, cfg.Gateway, cfg.FullUserName, cfg.FindUserName, cfg.Group, cfg.MaskedProxyServer()))
+
+	// При запуске из консоли (отладка) работаем без SCM
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		logWarn(fmt.Sprintf("Cannot determine whether running as service: %v", err))
+	}
+	if isService {
+		// У службы под SCM нет консоли: --log-to-stdout только для запуска из консоли
+		logMutex.Lock()
+		consoleLogger = nil
+		logMutex.Unlock()
+		if err := svc.Run(serviceName, &serviceHandler{}); err != nil {
+			logError(fmt.Sprintf("Service failed: %v", err))
+		}
+	} else {
+		serviceLoop(consoleStop("service loop"), nil)
+	}
+
+	logEvent("ESPD Proxy Service stopped", nil)
+}
+
+// consoleStop возвращает канал, который закрывается по Ctrl+C или SIGTERM
+// (Go так передаёт закрытие консоли и выход из системы). Начатая проверка
+// успевает завершиться: serviceLoop видит stop только между проверками
+func consoleStop(name string) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		logInfo(fmt.Sprintf("Received %v, %s stopping", sig, name))
+		close(stop)
+	}()
+	return stop
+}
+
+// closeLog сбрасывает лог-файл на диск и закрывает его
+func closeLog() {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+	}
+	logger = nil
+}
+
+// serviceLoop выполняет проверки до закрытия канала stop
+func serviceLoop(stop, checkNow <-chan struct{}) {
+	server := startStatusServer()
+	defer stopStatusServer(server)
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	// Таймер остаётся страховкой на случай пропущенных уведомлений
+	changes := make(chan string, 1)
+	watchNetworkChanges(changes)
+
+	debounce := newStateDebouncer(debounceCount)
+	cooldown := newApplyCooldown(applyInterval)
+	interval := newAdaptiveInterval(checkInterval, maxInterval)
+	current := checkInterval
+	check := func() {
+		if next := interval.observe(safeCheckAndSetProxy(debounce, cooldown)); next != current {
+			current = next
+			ticker.Reset(current)
+		}
+	}
+	check()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-cooldown.ready:
+			cooldown.pending = false
+			logDebug("Apply cooldown elapsed, checking conditions")
+			check()
+		case <-ticker.C:
+			check()
+		case <-checkNow:
+			logInfo("Check requested with --check-now")
+			check()
+		case <-recheckRequests:
+			logInfo("Check requested from the notification")
+			check()
+		case source := <-changes:
+			logDebug(fmt.Sprintf("Network change detected (%s), checking conditions", source))
+			drainNetworkChanges(changes)
+			interval.reset("network change")
+			check()
+		}
+	}
+}
+
+// buildServiceArgs возвращает параметры командной строки службы,
+// соответствующие текущей конфигурации
+func buildServiceArgs() []string {
+	// Файл исключений передаётся службе ссылкой, чтобы правки применялись после перезапуска
+	override := cfg.Override
+	if overrideFile != "" {
+		override = "@" + overrideFile
+	}
+
+	args := []string{
+		"--service",
+		"--service-name=" + serviceName,
+		"--service-desc=" + serviceDescription,
+		"--mode=" + cfg.Mode,
+		"--gateway=" + cfg.Gateway,
+		"--proxy=" + cfg.Server,
+		"--override=" + override,
+	}
+
+	if cfg.BypassDomains != "" {
+		args = append(args, "--bypass-domains="+cfg.BypassDomains)
+	}
+	if cfg.AutoLocalBypass {
+		args = append(args, "--auto-local-bypass")
+	}
+
+	if cfg.FullUserName != "" {
+		args = append(args, "--fullname="+cfg.FullUserName)
+	}
+	if cfg.FindUserName != "" {
+		args = append(args, "--findname="+cfg.FindUserName)
+	}
+	if cfg.Hostname != "" {
+		args = append(args, "--hostname="+cfg.Hostname)
+	}
+	if cfg.HostnameFind != "" {
+		args = append(args, "--hostname-find="+cfg.HostnameFind)
+	}
+	if cfg.ExcludeFullName != "" {
+		args = append(args, "--exclude-fullname="+cfg.ExcludeFullName)
+	}
+	if cfg.ExcludeFindName != "" {
+		args = append(args, "--exclude-findname="+cfg.ExcludeFindName)
+	}
+	if cfg.NameRegex != "" {
+		args = append(args, "--nameregex="+cfg.NameRegex)
+	}
+	if cfg.CaseSensitive {
+		args = append(args, "--case-sensitive")
+	}
+	if dryRun {
+		args = append(args, "--dryrun")
+	}
+	if auditMode {
+		args = append(args, "--audit")
+	}
+	if cfg.Invert {
+		args = append(args, "--invert")
+	}
+	if listenAddr != "" {
+		args = append(args, "--listen="+listenAddr)
+	}
+	if cfg.WinHTTP {
+		args = append(args, "--winhttp")
+	}
+	if cfg.DotNet {
+		args = append(args, "--dotnet")
+	}
+	if profileName != "" {
+		args = append(args, "--profile="+profileName)
+	}
+	if cfg.AllSessions {
+		args = append(args, "--all-sessions")
+	}
+	if cfg.NoRestore {
+		args = append(args, "--no-restore")
+	}
+	if cfg.GPO {
+		args = append(args, "--gpo")
+	}
+	if cfg.ServerOnly {
+		args = append(args, "--update-server-only")
+	}
+	if cfg.NoRefresh {
+		args = append(args, "--no-refresh")
+	}
+	if cfg.Hours != "" {
+		args = append(args, "--hours="+cfg.Hours)
+	}
+	if cfg.Days != "" {
+		args = append(args, "--days="+cfg.Days)
+	}
+	if checkInterval != defaultInterval {
+		args = append(args, "--interval="+checkInterval.String())
+	}
+	if maxInterval > 0 {
+		args = append(args, "--max-interval="+maxInterval.String())
+	}
+	if applyInterval > 0 {
+		args = append(args, "--min-apply-interval="+applyInterval.String())
+	}
+	if debounceCount > 1 {
+		args = append(args, fmt.Sprintf("--debounce=%d", debounceCount))
+	}
+	if notifyUser {
+		args = append(args, "--notify")
+	}
+	if verifyProxy {
+		args = append(args, "--verify-proxy")
+	}
+	if cfg.Retries != 3 {
+		args = append(args, fmt.Sprintf("--retries=%d", cfg.Retries))
+	}
+	if !logFileFlag {
+		args = append(args, "--logfile=false")
+	}
+	if logFormat != "text" {
+		args = append(args, "--logformat="+logFormat)
+	}
+	if minLogLevel != levelInfo {
+		args = append(args, "--loglevel="+logLevelNames[minLogLevel])
+	}
+	if logRotate != "" {
+		args = append(args, "--logrotate="+logRotate)
+	}
+	if logKeep != 3 {
+		args = append(args, fmt.Sprintf("--logkeep=%d", logKeep))
+	}
+	if logPathFlag != "" {
+		args = append(args, "--logpath="+logPathFlag)
+	}
+	if cfg.GatewaySites != "" {
+		args = append(args, "--gateway-sites="+cfg.GatewaySites)
+	}
+	if cfg.GatewayIface != "" {
+		args = append(args, "--gateway-iface="+cfg.GatewayIface)
+	}
+	if cfg.PingCheck {
+		args = append(args, "--ping-check", "--ping-timeout="+cfg.PingTimeout.String())
+	}
+	if cfg.InterfaceInclude != "" {
+		args = append(args, "--interface-include="+cfg.InterfaceInclude)
+	}
+	if cfg.InterfaceExclude != "" {
+		args = append(args, "--interface-exclude="+cfg.InterfaceExclude)
+	}
+	if cfg.Group != "" {
+		args = append(args, "--group="+cfg.Group)
+	}
+	if cfg.SID != "" {
+		args = append(args, "--sid="+cfg.SID)
+	}
+	if cfg.SSID != "" {
+		args = append(args, "--ssid="+cfg.SSID)
+	}
+	if cfg.DNSSuffix != "" {
+		args = append(args, "--dnssuffix="+cfg.DNSSuffix)
+	}
+	if cfg.DNSServer != "" {
+		args = append(args, "--dns-server="+cfg.DNSServer)
+	}
+	if cfg.Probe != "" {
+		args = append(args, "--probe="+cfg.Probe, "--probe-timeout="+cfg.ProbeTimeout.String())
+	}
+	if cfg.DHCPOption != 0 {
+		args = append(args, fmt.Sprintf("--dhcp-option=%d", cfg.DHCPOption), "--dhcp-value="+cfg.DHCPValue)
+	}
+	if cfg.CheckCommand != "" {
+		args = append(args, "--check-command="+cfg.CheckCommand, "--check-timeout="+cfg.CheckTimeout.String())
+	}
+	if cfg.VPNPattern != "" {
+		args = append(args, "--vpn-pattern="+cfg.VPNPattern)
+	}
+	if cfg.VPNForcesOn {
+		args = append(args, "--vpn-forces-on")
+	}
+	if cfg.SkipMetered {
+		args = append(args, "--skip-metered")
+	}
+	if cfg.GatewayMAC != "" {
+		args = append(args, "--gatewaymac="+cfg.GatewayMAC)
+	}
+	if cfg.ARPPing {
+		args = append(args, "--arp-ping")
+	}
+	if cfg.HTTP != "" {
+		args = append(args, "--proxy-http="+cfg.HTTP)
+	}
+	if cfg.HTTPS != "" {
+		args = append(args, "--proxy-https="+cfg.HTTPS)
+	}
+	if cfg.FTP != "" {
+		args = append(args, "--proxy-ftp="+cfg.FTP)
+	}
+	if cfg.ProxyUser != "" {
+		args = append(args, "--proxy-user="+cfg.ProxyUser)
+	}
+	// Сам пароль хранится в защищённом ключе, см. storeProxyPassword
+	if cfg.ProxyPassword != "" {
+		args = append(args, "--proxy-pass-stored")
+	}
+
+	return args
+}
+
+func installService() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Service was not installed. Use --proxy=host:port")
+		return exitBadArgs
+	}
+	if !resolveAutoGateway() {
+		return exitBadArgs
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error getting executable path: %v\n", err)
+		return exitError
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		fmt.Printf("Warning: could not register event log source: %v\n", err)
+	}
+
+	startType, delayed, err := serviceStartType()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitBadArgs
+	}
+
+	// Пароль прокси в binPath прочитал бы любой пользователь через sc qc
+	if cfg.ProxyPassword != "" {
+		if err := storeProxyPassword(cfg.ProxyPassword); err != nil {
+			fmt.Printf("Error saving proxy password: %v\n", err)
+			return exitRegistryError
+		}
+	} else if err := removeStoredCredentials(); err != nil {
+		fmt.Printf("Warning: could not remove the stored proxy password: %v\n", err)
+	}
+
+	// mgr сам экранирует аргументы при сборке binPath
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName:      serviceDescription,
+		Description:      serviceDescription,
+		StartType:        startType,
+		DelayedAutoStart: delayed,
+	}, buildServiceArgs()...)
+	if err != nil {
+		fmt.Printf("Error creating service: %v\n", err)
+		return exitServiceError
+	}
+	defer s.Close()
+
+	// Аналог sc failure ... reset= 86400 actions= restart/60000/restart/60000/restart/60000
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		fmt.Printf("Warning: could not configure recovery actions: %v\n", err)
+	}
+
+	// --no-start: служба создаётся, но запускается позже (после перезагрузки
+	// или проверки конфигурации)
+	if !noStart {
+		err = s.Start()
+		if err != nil {
+			fmt.Printf("Error starting service: %v\n", err)
+			return exitServiceError
+		}
+	}
+
+	fmt.Printf("Service '%s' installed successfully with configuration:\n", serviceName)
+	fmt.Printf("  Mode: %s\n", cfg.Mode)
+	if dryRun {
+		fmt.Printf("  Dry run: proxy settings will not be changed\n")
+	}
+	if cfg.Invert {
+		fmt.Printf("  Inverted: proxy is enabled when conditions are NOT met\n")
+	}
+	if cfg.HasSchedule() {
+		fmt.Printf("  Schedule: hours %s, days %s\n", orDefault(cfg.Hours, "any"), orDefault(cfg.Days, "any"))
+	}
+	if cfg.Mode == "gateway" || cfg.Mode == "both" {
+		fmt.Printf("  Gateway: %s\n", cfg.Gateway)
+		if cfg.GatewayIface != "" {
+			fmt.Printf("  Gateway interface: %s\n", cfg.GatewayIface)
+		}
+	}
+	if cfg.Mode == "user" || cfg.Mode == "both" {
+		if cfg.FullUserName != "" {
+			fmt.Printf("  Full username: %s\n", cfg.FullUserName)
+		}
+		if cfg.FindUserName != "" {
+			fmt.Printf("  Find username: %s\n", cfg.FindUserName)
+		}
+		if cfg.NameRegex != "" {
+			fmt.Printf("  Username regex: %s\n", cfg.NameRegex)
+		}
+	}
+	if (cfg.Mode == "group" || cfg.Mode == "both") && cfg.Group != "" {
+		fmt.Printf("  Group: %s\n", cfg.Group)
+	}
+	if (cfg.Mode == "sid" || cfg.Mode == "both") && cfg.SID != "" {
+		fmt.Printf("  User SID: %s\n", cfg.SID)
+	}
+	if (cfg.Mode == "ssid" || cfg.Mode == "both") && cfg.SSID != "" {
+		fmt.Printf("  SSID: %s\n", cfg.SSID)
+	}
+	if (cfg.Mode == "dnssuffix" || cfg.Mode == "both") && cfg.DNSSuffix != "" {
+		fmt.Printf("  DNS suffix: %s\n", cfg.DNSSuffix)
+	}
+	if (cfg.Mode == "dns" || cfg.Mode == "both") && cfg.DNSServer != "" {
+		fmt.Printf("  DNS server: %s\n", cfg.DNSServer)
+	}
+	if (cfg.Mode == "reachable" || cfg.Mode == "both") && cfg.Probe != "" {
+		fmt.Printf("  Probe: %s (timeout %s)\n", cfg.Probe, cfg.ProbeTimeout)
+	}
+	if (cfg.Mode == "gatewaymac" || cfg.Mode == "both") && cfg.GatewayMAC != "" {
+		fmt.Printf("  Gateway MAC: %s\n", cfg.GatewayMAC)
+	}
+	if cfg.Mode == "dhcpoption" {
+		fmt.Printf("  DHCP option: %d = %s\n", cfg.DHCPOption, cfg.DHCPValue)
+	}
+	fmt.Printf("  Proxy: %s\n", cfg.MaskedProxyServer())
+	fmt.Printf("  Override: %s\n", cfg.ProxyOverride())
+	if logFileFlag && logPathFlag != "" {
+		fmt.Printf("  Log file: %s\n", resolveLogPath())
+	}
+	fmt.Printf("  Start type: %s\n", effectiveStartType())
+	if noStart {
+		fmt.Printf("\nThe service was not started. Start it with: sc start %s\n", serviceName)
+		if startType == mgr.StartAutomatic {
+			fmt.Println("It will also start automatically at the next boot.")
+		}
+	}
+	return exitOK
+}
+
+// effectiveStartType учитывает --manual как сокращение для --start-type=manual
+func effectiveStartType() string {
+	if manualStart && !explicitFlags()["start-type"] {
+		return "manual"
+	}
+	return startTypeFlag
+}
+
+// serviceStartType переводит --start-type в параметры CreateService.
+// delayed-auto - автоматический запуск с флагом отложенного старта, служба
+// стартует после загрузки сетевого стека и первая проверка надёжнее
+func serviceStartType() (uint32, bool, error) {
+	switch effectiveStartType() {
+	case "auto":
+		return mgr.StartAutomatic, false, nil
+	case "delayed-auto":
+		return mgr.StartAutomatic, true, nil
+	case "manual":
+		return mgr.StartManual, false, nil
+	case "disabled":
+		return mgr.StartDisabled, false, nil
+	}
+	return 0, false, fmt.Errorf("unknown start type %q, expected auto, delayed-auto, manual, or disabled", startTypeFlag)
+}
+
+// scStartType возвращает тип запуска службы в форме параметра start= для sc create
+func scStartType(config mgr.Config) string {
+	switch {
+	case config.StartType == mgr.StartAutomatic && config.DelayedAutoStart:
+		return "delayed-auto"
+	case config.StartType == mgr.StartManual:
+		return "demand"
+	case config.StartType == mgr.StartDisabled:
+		return "disabled"
+	}
+	return "auto"
+}
+
+// selfUpdate скачивает новый исполняемый файл, проверяет SHA-256 и заменяет
+// файл, который запускает служба (без службы - текущий): запущенный exe нельзя
+// перезаписать, но можно переименовать, поэтому старый файл сохраняется как
+// .old, а новый встаёт на его место. Затем служба перезапускается, в том числе
+// если замена не удалась
+func selfUpdate(url, expectedSHA string) (code int) {
+	if !strings.HasPrefix(strings.ToLower(url), "https://") {
+		fmt.Println("Error: --update requires an https:// URL")
+		return exitBadArgs
+	}
+	expectedSHA = strings.ToLower(strings.TrimSpace(expectedSHA))
+	if len(expectedSHA) != sha256.Size*2 {
+		fmt.Println("Error: --update requires --update-sha with the 64-character SHA-256 of the new executable")
+		return exitBadArgs
+	}
+	if !checkElevated() {
+		return exitNotElevated
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	var exePath string
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		defer s.Close()
+		args, err := serviceCommandLine(s)
+		if err != nil {
+			fmt.Printf("Error reading service executable path: %v\n", err)
+			return exitServiceError
+		}
+		exePath = args[0]
+	} else {
+		exePath, err = os.Executable()
+		if err != nil {
+			fmt.Printf("Error getting executable path: %v\n", err)
+			return exitError
+		}
+	}
+	newPath := exePath + ".new"
+	oldPath := exePath + ".old"
+
+	fmt.Printf("Downloading %s\n", url)
+	actualSHA, err := downloadFile(url, newPath)
+	if err != nil {
+		os.Remove(newPath)
+		fmt.Printf("Error downloading update: %v\n", err)
+		return exitError
+	}
+	if actualSHA != expectedSHA {
+		os.Remove(newPath)
+		fmt.Printf("Error: SHA-256 mismatch, expected %s, got %s. Update refused\n", expectedSHA, actualSHA)
+		return exitError
+	}
+	fmt.Println("SHA-256 verified")
+
+	if s != nil {
+		if err := stopService(s); err == nil {
+			fmt.Printf("Service '%s' stopped\n", serviceName)
+		}
+		// Служба запускается и после неудачной замены - с прежним файлом
+		defer func() {
+			if err := s.Start(); err != nil {
+				fmt.Printf("Error starting service: %v\n", err)
+				if code == exitOK {
+					code = exitServiceError
+				}
+				return
+			}
+			fmt.Printf("Service '%s' restarted\n", serviceName)
+		}()
+	}
+
+	os.Remove(oldPath)
+	if err := os.Rename(exePath, oldPath); err != nil {
+		os.Remove(newPath)
+		fmt.Printf("Error moving current executable aside: %v\n", err)
+		return exitError
+	}
+	if err := os.Rename(newPath, exePath); err != nil {
+		fmt.Printf("Error installing new executable: %v\n", err)
+		// Возвращаем прежний файл, чтобы служба могла запуститься
+		if err := os.Rename(oldPath, exePath); err != nil {
+			fmt.Printf("Error restoring previous executable from %s: %v\n", oldPath, err)
+		}
+		return exitError
+	}
+	fmt.Printf("Executable %s replaced, previous version saved as %s\n", exePath, oldPath)
+	return exitOK
+}
+
+// downloadFile сохраняет url в path и возвращает SHA-256 содержимого
+func downloadFile(url, path string) (string, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// stopService отправляет службе команду остановки и ждёт её завершения
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Now().Add(10 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(timeout) {
+			return fmt.Errorf("timeout waiting for service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		status, err = s.Query()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForDeletion ждёт, пока SCM окончательно удалит службу: до этого
+// CreateService с тем же именем завершается ошибкой ERROR_SERVICE_MARKED_FOR_DELETE
+func waitForDeletion(m *mgr.Mgr) error {
+	timeout := time.Now().Add(10 * time.Second)
+	for {
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return nil
+		}
+		s.Close()
+
+		if time.Now().After(timeout) {
+			return fmt.Errorf("timeout waiting for service to be deleted")
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// serviceBinPath - командная строка службы в том виде, в каком её собирает
+// mgr.CreateService (каждый аргумент экранируется по правилам CommandLineToArgvW)
+func serviceBinPath(exePath string) string {
+	return windows.ComposeCommandLine(append([]string{exePath}, buildServiceArgs()...))
+}
+
+// printBinPath выводит binPath, который зарегистрировал бы --install, не создавая службу
+func printBinPath() int {
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitBadArgs
+	}
+	if cfg.Gateway == proxy.AutoGateway {
+		gateway, err := cfg.ResolveAutoGateway()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitBadArgs
+		}
+		fmt.Fprintf(os.Stderr, "--gateway=auto resolves to %s on this machine\n", gateway)
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting executable path: %v\n", err)
+		return exitError
+	}
+
+	if cfg.ProxyPassword != "" {
+		fmt.Fprintf(os.Stderr, "--proxy-pass is not in the command line: --install saves it to HKLM\\%s\n", credentialsKeyPath())
+	}
+
+	// Только командная строка в stdout, чтобы её можно было подставить в сценарий
+	fmt.Println(serviceBinPath(exePath))
+	return exitOK
+}
+
+// resolveAutoGateway подставляет в параметры службы текущий шлюз вместо --gateway=auto
+func resolveAutoGateway() bool {
+	if cfg.Gateway != proxy.AutoGateway {
+		return true
+	}
+	gateway, err := cfg.ResolveAutoGateway()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+	fmt.Printf("Captured current default gateway for --gateway=auto: %s\n", gateway)
+	return true
+}
+
+// reinstallService удаляет установленную службу и создаёт её заново с текущими
+// параметрами. Настройки прокси при этом не сбрасываются
+func reinstallService() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+	if err := cfg.ValidateProxy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Service was not reinstalled. Use --proxy=host:port")
+		return exitBadArgs
+	}
+	// До удаления старой службы, чтобы не остаться без неё из-за ошибки
+	if !resolveAutoGateway() {
+		return exitBadArgs
+	}
+	if _, _, err := serviceStartType(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return exitBadArgs
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	previousBinPath := ""
+	previousStart := "auto"
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("Service '%s' is not installed, installing\n", serviceName)
+	} else {
+		if config, err := s.Config(); err == nil {
+			previousBinPath = config.BinaryPathName
+			previousStart = scStartType(config)
+		}
+		if err := stopService(s); err == nil {
+			fmt.Printf("Service '%s' stopped\n", serviceName)
+		}
+		err = s.Delete()
+		s.Close()
+		if err != nil {
+			fmt.Printf("Error deleting service: %v\n", err)
+			return exitServiceError
+		}
+		if err := waitForDeletion(m); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitServiceError
+		}
+		fmt.Printf("Service '%s' deleted\n", serviceName)
+	}
+
+	code := installService()
+
+	// Служба создана, но не запустилась - старую конфигурацию восстанавливать не нужно
+	if code != exitOK && previousBinPath != "" {
+		if s, err := m.OpenService(serviceName); err == nil {
+			s.Close()
+		} else {
+			fmt.Println("")
+			fmt.Println("The previous service was removed but the new one could not be created.")
+			fmt.Println("To restore the previous configuration run:")
+			fmt.Printf("  sc create %s binPath= \"%s\" start= %s\n", serviceName, strings.ReplaceAll(previousBinPath, `"`, `\"`), previousStart)
+		}
+	}
+	return code
+}
+
+// checkElevated проверяет, что процесс запущен с правами администратора:
+// без них создание службы и запись в HKLM завершаются непонятными ошибками
+// SCM и реестра уже посреди операции
+func checkElevated() bool {
+	if windows.GetCurrentProcessToken().IsElevated() {
+		return true
+	}
+	fmt.Println("Error: administrator rights are required for this operation.")
+	fmt.Println("Please run the command from an elevated prompt (Run as administrator).")
+	return false
+}
+
+// checkNowService отправляет запущенной службе код checkNowControl
+func checkNowService() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("Error opening service '%s': %v\n", serviceName, err)
+		return exitServiceError
+	}
+	defer s.Close()
+
+	if _, err := s.Control(checkNowControl); err != nil {
+		fmt.Printf("Error sending check request to '%s': %v\n", serviceName, err)
+		return exitServiceError
+	}
+
+	fmt.Printf("Service '%s' will check conditions now\n", serviceName)
+	return exitOK
+}
+
+// credentialsKeyPath - ключ с паролем прокси для службы
+func credentialsKeyPath() string {
+	return statusKeyPath() + `\Credentials`
+}
+
+const (
+	proxyPasswordValue = "ProxyPassword"
+
+	// Защищённый DACL без наследования: доступ только у SYSTEM и администраторов
+	credentialsSDDL = "D:P(A;OICI;KA;;;SY)(A;OICI;KA;;;BA)"
+)
+
+// storeProxyPassword сохраняет --proxy-pass для службы, которой в binPath
+// передаётся только --proxy-pass-stored. DACL ключа меняется до записи
+// значения, поэтому пароль не бывает доступен обычным пользователям
+func storeProxyPassword(password string) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, credentialsKeyPath(), registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("cannot create HKLM\\%s: %v", credentialsKeyPath(), err)
+	}
+	defer k.Close()
+
+	sd, err := windows.SecurityDescriptorFromString(credentialsSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	err = windows.SetSecurityInfo(windows.Handle(k), windows.SE_REGISTRY_KEY,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+	if err != nil {
+		return fmt.Errorf("cannot restrict access to HKLM\\%s: %v", credentialsKeyPath(), err)
+	}
+
+	return k.SetStringValue(proxyPasswordValue, password)
+}
+
+func loadProxyPassword() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, credentialsKeyPath(), registry.QUERY_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer k.Close()
+
+	password, _, err := k.GetStringValue(proxyPasswordValue)
+	return password, err
+}
+
+func removeStoredCredentials() error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, credentialsKeyPath())
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// killSwitchValue - отметка --disable-now в ключе состояния
+const killSwitchValue = "KillSwitch"
+
+func killSwitchActive() bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+
+	value, _, err := k.GetIntegerValue(killSwitchValue)
+	return err == nil && value != 0
+}
+
+// disableNow - аварийное выключение: отметка в реестре ставится до остановки
+// службы, чтобы она не включила прокси снова, даже если остановка не удалась
+func disableNow() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		fmt.Printf("Error opening status key HKLM\\%s: %v\n", statusKeyPath(), err)
+		return exitServiceError
+	}
+	err = k.SetDWordValue(killSwitchValue, 1)
+	k.Close()
+	if err != nil {
+		fmt.Printf("Error setting kill switch: %v\n", err)
+		return exitServiceError
+	}
+	fmt.Println("Kill switch set, the proxy stays disabled until --enable-now")
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Warning: cannot connect to service manager: %v\n", err)
+	} else {
+		defer m.Disconnect()
+		if s, err := m.OpenService(serviceName); err == nil {
+			// Выключается то, что включала служба: --all-sessions, --winhttp,
+			// --dotnet и --gpo берутся из её командной строки
+			if err := loadServiceArgs(s); err != nil {
+				fmt.Printf("Warning: cannot read the service command line, using this one: %v\n", err)
+			}
+			if err := stopService(s); err == nil {
+				fmt.Printf("Service '%s' stopped\n", serviceName)
+			}
+			s.Close()
+		} else {
+			fmt.Printf("Warning: service '%s' is not installed, using this command line\n", serviceName)
+		}
+	}
+
+	// Аварийное выключение: прокси выключается везде, а не возвращается
+	// к сохранённой настройке пользователя, которая тоже может быть прокси
+	cfg.NoRestore = true
+	cfg.ServerOnly = false
+	setSessionRefreshCommand()
+	if err := cfg.SetProxy(false); err != nil {
+		fmt.Printf("Error disabling proxy: %v\n", err)
+		return exitRegistryError
+	}
+	fmt.Println("Proxy disabled")
+	return exitOK
+}
+
+// serviceCommandLine возвращает командную строку установленной службы,
+// args[0] - путь к исполняемому файлу
+func serviceCommandLine(s *mgr.Service) ([]string, error) {
+	config, err := s.Config()
+	if err != nil {
+		return nil, err
+	}
+	args, err := windows.DecomposeCommandLine(config.BinaryPathName)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty service command line")
+	}
+	return args, nil
+}
+
+// loadServiceArgs разбирает командную строку установленной службы поверх
+// флагов этого запуска
+func loadServiceArgs(s *mgr.Service) error {
+	args, err := serviceCommandLine(s)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet(serviceName, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs.Parse(args[1:])
+}
+
+// enableNow снимает отметку --disable-now и запускает службу, если она установлена
+func enableNow() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, statusKeyPath(), registry.SET_VALUE)
+	if err == nil {
+		err = k.DeleteValue(killSwitchValue)
+		k.Close()
+	}
+	if err != nil && err != registry.ErrNotExist {
+		fmt.Printf("Error clearing kill switch: %v\n", err)
+		return exitServiceError
+	}
+	fmt.Println("Kill switch cleared")
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("Service '%s' is not installed, nothing to start\n", serviceName)
+		return exitOK
+	}
+	defer s.Close()
+
+	if status, err := s.Query(); err == nil && status.State == svc.Running {
+		fmt.Printf("Service '%s' is running and will apply settings on the next check\n", serviceName)
+		return exitOK
+	}
+	if err := s.Start(); err != nil {
+		fmt.Printf("Error starting service '%s': %v\n", serviceName, err)
+		return exitServiceError
+	}
+	fmt.Printf("Service '%s' started\n", serviceName)
+	return exitOK
+}
+
+func uninstallService() int {
+	if !checkElevated() {
+		return exitNotElevated
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("Error connecting to service manager: %v\n", err)
+		return exitServiceError
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Printf("Error opening service '%s': %v\n", serviceName, err)
+		return exitServiceError
+	}
+	defer s.Close()
+
+	// Прокси выключается там, куда его записывала служба (--all-sessions,
+	// --winhttp, --dotnet, --gpo), а не по флагам этого запуска
+	if err := loadServiceArgs(s); err != nil {
+		fmt.Printf("Warning: cannot read the service command line, using this one: %v\n", err)
+	}
+
+	if err := stopService(s); err == nil {
+		fmt.Printf("Service '%s' stopped\n", serviceName)
+	}
+
+	// Выключаем прокси до удаления службы, чтобы машина вернулась в исходное состояние
+	if keepProxy {
+		fmt.Println("Proxy settings left unchanged (--keep-proxy)")
+	} else if err := cfg.SetProxy(false); err != nil {
+		fmt.Printf("Warning: could not disable proxy: %v\n", err)
+	} else {
+		fmt.Println("Proxy disabled")
+	}
+	if err := cfg.RemoveOriginalSettings(); err != nil {
+		fmt.Printf("Warning: could not remove the saved original proxy settings: %v\n", err)
+	} else {
+		fmt.Println("Saved original proxy settings removed")
+	}
+
+	err = s.Delete()
+	if err != nil {
+		fmt.Printf("Error deleting service: %v\n", err)
+		return exitServiceError
+	}
+	fmt.Printf("Service '%s' deleted\n", serviceName)
+
+	if err := removeStoredCredentials(); err != nil {
+		fmt.Printf("Warning: could not remove the stored proxy password: %v\n", err)
+	}
+	if err := registry.DeleteKey(registry.LOCAL_MACHINE, statusKeyPath()); err != nil && err != registry.ErrNotExist {
+		fmt.Printf("Warning: could not remove status key HKLM\\%s: %v\n", statusKeyPath(), err)
+	}
+
+	if err := eventlog.Remove(serviceName); err != nil {
+		fmt.Printf("Warning: could not remove event log source: %v\n", err)
+	} else {
+		fmt.Println("Event log source removed")
+	}
+
+	fmt.Printf("Service '%s' uninstalled successfully\n", serviceName)
+	return exitOK
+}
+
+func printHelp() {
+	fmt.Printf("ESPD Proxy Service\n")
+	fmt.Printf("Usage: %s [options]\n", os.Args[0])
+	fmt.Printf("\nOptions:\n")
+	fmt.Printf("  --install                Install as Windows service\n")
+	fmt.Printf("  --uninstall              Remove Windows service\n")
+	fmt.Printf("  --reinstall              Recreate the service with new options (proxy settings kept)\n")
+	fmt.Printf("  --update url             Replace the service executable with a download from this HTTPS URL\n")
+	fmt.Printf("                           and restart the service (requires --update-sha)\n")
+	fmt.Printf("  --update-sha string      Expected SHA-256 of the download; the update is refused on mismatch\n")
+	fmt.Printf("  --check-now              Make the running service check conditions immediately\n")
+	fmt.Printf("  --disable-now            Kill switch: stop the service, disable the proxy and keep it\n")
+	fmt.Printf("                           disabled (even after restart) until --enable-now\n")
+	fmt.Printf("  --enable-now             Clear the kill switch and start the service again\n")
+	fmt.Printf("  --diagnose               Print one report (config, gateways, user, registry, service) for support\n")
+	fmt.Printf("  --keep-proxy             Do not disable proxy on --uninstall\n")
+	fmt.Printf("  --profile string         Isolated instance: service ESPDProxyService-NAME, status key\n")
+	fmt.Printf("                           HKLM\\SOFTWARE\\ESPDProxyService-NAME, log espdproxy-NAME.log\n")
+	fmt.Printf("  --no-start               With --install: create the service but do not start it\n")
+	fmt.Printf("  --manual                 With --install: manual start instead of automatic at boot\n")
+	fmt.Printf("  --start-type string      auto, delayed-auto, manual, or disabled (default: auto)\n")
+	fmt.Printf("  --service-name string    Service name (default: ESPDProxyService); also used by --uninstall\n")
+	fmt.Printf("  --service-desc string    Service display name and description\n")
+	fmt.Printf("  --restart-delay duration Delay before restart after a crash (default: 1m0s)\n")
+	fmt.Printf("  --service                Run as service (for internal use)\n")
+	fmt.Printf("  --test                   Test mode\n")
+	fmt.Printf("  --json                   With --test: print a JSON object instead of the text report\n")
+	fmt.Printf("  --apply                  Apply proxy settings once and exit\n")
+	fmt.Printf("                           Exit codes: 0 enabled, 10 disabled (see below for errors)\n")
+	fmt.Printf("  --once-and-watch         Apply now, then follow network changes until logoff (logon scripts)\n")
+	fmt.Printf("  --validate               Validate configuration and exit (non-zero on problems)\n")
+	fmt.Printf("  --config string          JSON configuration file (keys are option names)\n")
+	fmt.Printf("  --whoami                 Show the current user name formats and whether they match\n")
+	fmt.Printf("  --list-gateways          Show detected routes, adapters and gateways\n")
+	fmt.Printf("  --export-config string   Write the effective configuration to a JSON file\n")
+	fmt.Printf("  --print-binpath          Print the exact service command line --install would register\n")
+	fmt.Printf("  --version                Show version and build information\n")
+	fmt.Printf("  --logfile                Write log file in addition to Event Log (default: true)\n")
+	fmt.Printf("  --logformat string       Log format: text or json (default: text)\n")
+	fmt.Printf("  --logkeep int            Number of rotated log files to keep (default: 3)\n")
+	fmt.Printf("  --log-to-stdout          Also print log entries to the console (stderr with --json);\n")
+	fmt.Printf("                           add --logfile=false to log only to the console. Not passed to\n")
+	fmt.Printf("                           the installed service, which keeps logging to the file\n")
+	fmt.Printf("  --logrotate daily        Write one file per day (espdproxy-YYYY-MM-DD.log); --logkeep then\n")
+	fmt.Printf("                           counts previous days, the 15MB size limit still applies per day\n")
+	fmt.Printf("  --loglevel string        Log level: DEBUG, INFO, WARN, or ERROR (default: INFO)\n")
+	fmt.Printf("  --verbose                Same as --loglevel=DEBUG\n")
+	fmt.Printf("  --quiet                  Same as --loglevel=ERROR\n")
+	fmt.Printf("  --logpath string         Log file path or directory (default: %%TEMP%%\\espdproxy.log)\n")
+	fmt.Printf("  --help, -h               Show this help\n")
+	fmt.Printf("\nConfiguration options:\n")
+	fmt.Printf("  --mode string            Check mode: gateway, user, group, ssid, dnssuffix, reachable, gatewaymac, vpn, script, hostname, dhcpoption, dns, sid, or both (default: gateway)\n")
+	fmt.Printf("  --gateway string         Target gateway IP (default: 192.168.1.1)\n")
+	fmt.Printf("                           CIDR (10.0.0.0/16) or prefix (192.168. or 10.0.*) also match\n")
+	fmt.Printf("                           auto: --install records the machine's current default gateway\n")
+	fmt.Printf("  --gateway-sites list     Labeled gateways site1=10.0.1.1;site2=10.0.2.1 (replaces --gateway);\n")
+	fmt.Printf("                           in --config also [{\"label\": \"site1\", \"gateway\": \"10.0.1.1\"}]\n")
+	fmt.Printf("  --gateway-iface string   Match the gateway only on this adapter (name or interface index)\n")
+	fmt.Printf("  --gateway-adapter string Same as --gateway-iface, e.g. --gateway-adapter=ESPD-NIC\n")
+	fmt.Printf("  --ping-check             Only trust a gateway match if the gateway answers ICMP echo\n")
+	fmt.Printf("  --ping-timeout duration  Timeout for --ping-check (default: 2s)\n")
+	fmt.Printf("  --interface-include list Only use gateways of adapters matching these names (';' list)\n")
+	fmt.Printf("  --interface-exclude list Ignore gateways of adapters matching these names, e.g. \"VPN;VirtualBox\"\n")
+	fmt.Printf("  --fullname string        Exact username match, list separated by ';' allowed\n")
+	fmt.Printf("                           DOMAIN\\user and user@domain.com (UPN) forms are both checked\n")
+	fmt.Printf("  --findname string        Partial username match, list separated by ';' allowed\n")
+	fmt.Printf("                           Name lists accept * and ? wildcards, e.g. *@contoso.com or AzureAD\\*;\n")
+	fmt.Printf("                           AzureAD accounts are also checked by their cloud UPN\n")
+	fmt.Printf("  --hostname string        Exact computer name match (mode hostname), list separated by ';'\n")
+	fmt.Printf("  --hostname-find string   Partial computer name match (mode hostname), e.g. ESPD-KIOSK-\n")
+	fmt.Printf("  --exclude-fullname list  Exact usernames that never get the proxy, in any mode\n")
+	fmt.Printf("  --exclude-findname list  Partial usernames that never get the proxy (e.g. svc_)\n")
+	fmt.Printf("  --nameregex string       Regular expression username match\n")
+	fmt.Printf("  --case-sensitive         Compare usernames with exact casing (default: case-insensitive)\n")
+	fmt.Printf("  --group string           Group membership match (name, DOMAIN\\group or SID)\n")
+	fmt.Printf("  --sid list               User SID match (mode sid); S-1-5-21-...-* matches a whole domain\n")
+	fmt.Printf("  --ssid string            Wireless network SSID match\n")
+	fmt.Printf("  --dnssuffix string       Connection-specific DNS suffix match (e.g. espd.local)\n")
+	fmt.Printf("  --dns-server list        DNS server assigned to any active adapter (mode dns, ';' list)\n")
+	fmt.Printf("  --gatewaymac string      Default gateway MAC address match (mode gatewaymac)\n")
+	fmt.Printf("  --arp-ping               Ping the gateway if its ARP entry is missing\n")
+	fmt.Printf("  --probe string           Internal host:port that must be reachable (mode reachable)\n")
+	fmt.Printf("  --probe-timeout duration TCP dial timeout for --probe (default: 3s)\n")
+	fmt.Printf("  --dhcp-option int        DHCP option code read from the adapter lease (mode dhcpoption)\n")
+	fmt.Printf("  --dhcp-value string      Expected option value: text, or hex bytes (e.g. 0a:00:42:01)\n")
+	fmt.Printf("  --check-command string   Command for mode script (run with cmd /C): exit code 0 = enable\n")
+	fmt.Printf("  --check-timeout duration Timeout for --check-command (default: 30s)\n")
+	fmt.Printf("  --vpn-pattern string     VPN adapter name/description regex (mode vpn, --vpn-forces-on)\n")
+	fmt.Printf("                           PPP and tunnel adapters always count as VPN\n")
+	fmt.Printf("  --vpn-forces-on          Enable the proxy whenever a VPN is connected, whatever the mode\n")
+	fmt.Printf("  --skip-metered           Never enable the proxy on a metered (cellular, roaming) connection\n")
+	fmt.Printf("  --proxy string           Proxy server address:port (default: 10.0.66.52:3128)\n")
+	fmt.Printf("                           Comma-separated list: the first reachable one is used\n")
+	fmt.Printf("  --proxy-http string      HTTP proxy address:port (overrides --proxy)\n")
+	fmt.Printf("  --proxy-https string     HTTPS proxy address:port (overrides --proxy)\n")
+	fmt.Printf("  --proxy-ftp string       FTP proxy address:port (overrides --proxy)\n")
+	fmt.Printf("  --proxy-user string      Username embedded into the proxy address (user:pass@host:port)\n")
+	fmt.Printf("  --proxy-pass string      Password for --proxy-user, masked in logs. --install keeps it in\n")
+	fmt.Printf("                           HKLM\\SOFTWARE\\ESPDProxyService\\Credentials (SYSTEM and\n")
+	fmt.Printf("                           administrators only), not in the service command line\n")
+	fmt.Printf("                           Only for proxies that accept credentials in the address;\n")
+	fmt.Printf("                           WinINET clients normally use integrated NTLM/Kerberos auth\n")
+	fmt.Printf("  --override string        Proxy override list (default: 192.168.*.*;192.25.*.*;<local>)\n")
+	fmt.Printf("                           Use @path.txt to read one entry per line from a file\n")
+	fmt.Printf("  --auto-local-bypass      Bypass the proxy for the machine's own subnets (e.g. 10.1.2.*)\n")
+	fmt.Printf("  --bypass-domains list    Domain patterns added to the override list (';' list, e.g. *.intranet.local)\n")
+	fmt.Printf("  --retries int            Gateway detection attempts with backoff (default: 3)\n")
+	fmt.Printf("  --verify-proxy           Log a warning if the enabled proxy does not accept connections\n")
+	fmt.Printf("  --notify                 Notify the console user when proxy is enabled/disabled; the\n")
+	fmt.Printf("                           \"disabled\" message has a Retry button that re-checks at once\n")
+	fmt.Printf("                           (a message box via WTSSendMessage: a service in session 0\n")
+	fmt.Printf("                           cannot raise Windows toast notifications)\n")
+	fmt.Printf("  --invert                 Enable proxy when conditions are NOT met\n")
+	fmt.Printf("  --debounce int           Consecutive agreeing checks before changing state (default: 1)\n")
+	fmt.Printf("  --interval duration      Time between periodic checks (default: 1m)\n")
+	fmt.Printf("  --max-interval duration  While results do not change, double the interval every 3 checks\n")
+	fmt.Printf("                           up to this cap; network changes reset it to --interval\n")
+	fmt.Printf("  --min-apply-interval duration\n")
+	fmt.Printf("                           Minimum time between proxy state changes on flapping links\n")
+	fmt.Printf("  --listen string          Serve /healthz, /status and /metrics (Prometheus) over HTTP\n")
+	fmt.Printf("                           (e.g. :8085, localhost only)\n")
+	fmt.Printf("  --all-sessions           Write settings to HKEY_USERS\\<SID> of every logged-on user,\n")
+	fmt.Printf("                           disconnected sessions included (needed when the service runs\n")
+	fmt.Printf("                           as LocalSystem); user conditions are checked for each user\n")
+	fmt.Printf("  --no-restore             Disable the proxy instead of restoring the user's own settings\n")
+	fmt.Printf("                           (saved in HKCU\\Software\\ESPDProxyService\\OriginalSettings)\n")
+	fmt.Printf("  --update-server-only     Leave ProxyEnable as is: when conditions are met write ProxyServer\n")
+	fmt.Printf("                           and ProxyOverride, otherwise only remove ProxyServer\n")
+	fmt.Printf("                           (--no-restore is implied, the user's settings are not saved)\n")
+	fmt.Printf("  --gpo                    Also write to the policy keys when the proxy is enforced by GPO\n")
+	fmt.Printf("  --winhttp                Also set the WinHTTP (machine) proxy for services\n")
+	fmt.Printf("  --dotnet                 Also write <system.net><defaultProxy> to machine.config of every\n")
+	fmt.Printf("                           installed .NET Framework (original kept as *.espd-backup)\n")
+	fmt.Printf("  --no-refresh             Skip the UpdatePerUserSystemParameters refresh\n")
+	fmt.Printf("  --hours string           Allow proxy only in this time window, e.g. 08:00-18:00\n")
+	fmt.Printf("  --days string            Allow proxy only on these days, e.g. Mon-Fri\n")
+	fmt.Printf("  --dryrun                 Run the service loop but only log what would be changed\n")
+	fmt.Printf("  --audit                  Read-only: on every check log desired vs actual proxy state per user\n")
+	fmt.Printf("                           and warn on drift; can run as a service next to other tools\n")
+	fmt.Printf("  --simulate-gateway ip    Pretend ip is the default gateway (--test and --dryrun only)\n")
+	fmt.Printf("  --simulate-user name     Pretend to run as name, DOMAIN\\user or UPN (--test and --dryrun only)\n")
+	fmt.Printf("                           Both also apply to --whoami, --diagnose and --list-gateways\n")
+	fmt.Printf("\nThe last check is recorded in HKLM\\SOFTWARE\\ESPDProxyService (-NAME with --profile)\n")
+	fmt.Printf("(LastCheckTime, LastResult, LastError) for monitoring tools.\n")
+	fmt.Printf("\nEvery option can also be set with an ESPD_* environment variable\n")
+	fmt.Printf("(--mode -> ESPD_MODE, --proxy-http -> ESPD_PROXY_HTTP).\n")
+	fmt.Printf("Precedence: command line > environment > --config file > built-in defaults\n")
+	fmt.Printf("\nExit codes (--install, --uninstall, --apply):\n")
+	fmt.Printf("  0                        Success\n")
+	fmt.Printf("  1                        Generic error\n")
+	fmt.Printf("  2                        Bad arguments\n")
+	fmt.Printf("  3                        Registry error\n")
+	fmt.Printf("  4                        Service manager error\n")
+	fmt.Printf("  5                        Not running as administrator\n")
+	fmt.Printf("  10                       --apply: proxy disabled\n")
+	fmt.Printf("\nExamples:\n")
+	fmt.Printf("  # Check by gateway only (default)\n")
+	fmt.Printf("  %s --install --gateway=192.168.0.1\n", os.Args[0])
+	fmt.Printf("  # Ignore virtual and VPN adapters when matching the gateway\n")
+	fmt.Printf("  %s --install --gateway=192.168.1.1 --interface-exclude=\"VPN;VirtualBox;Hyper-V\"\n", os.Args[0])
+	fmt.Printf("  # Check by exact username\n")
+	fmt.Printf("  %s --install --mode=user --fullname=DOMAIN\\username\n", os.Args[0])
+	fmt.Printf("  # Check by partial username\n")
+	fmt.Printf("  %s --install --mode=user --findname=admin\n", os.Args[0])
+	fmt.Printf("  # Check by several exact usernames\n")
+	fmt.Printf("  %s --install --mode=user --fullname=\"DOMAIN\\svc1;DOMAIN\\svc2\"\n", os.Args[0])
+	fmt.Printf("  # Check by username pattern\n")
+	fmt.Printf("  %s --install --mode=user --nameregex=\"^svc-espd-\\d{4}$\"\n", os.Args[0])
+	fmt.Printf("  # Check by AD group membership\n")
+	fmt.Printf("  %s --install --mode=group --group=DOMAIN\\ESPD-Users\n", os.Args[0])
+	fmt.Printf("  # Check by connected WiFi network\n")
+	fmt.Printf("  %s --install --mode=ssid --ssid=ESPD-WIFI\n", os.Args[0])
+	fmt.Printf("  # Check by DNS suffix assigned by DHCP\n")
+	fmt.Printf("  %s --install --mode=dnssuffix --dnssuffix=espd.local\n", os.Args[0])
+	fmt.Printf("  # Check by reachability of the proxy itself\n")
+	fmt.Printf("  %s --install --mode=reachable --probe=10.0.66.52:3128\n", os.Args[0])
+	fmt.Printf("  # Check by the router's MAC address\n")
+	fmt.Printf("  %s --install --mode=gatewaymac --gatewaymac=aa-bb-cc-dd-ee-ff --arp-ping\n", os.Args[0])
+	fmt.Printf("  # Check by both gateway and username\n")
+	fmt.Printf("  %s --install --mode=both --gateway=192.168.1.1 --findname=user\n", os.Args[0])
+	fmt.Printf("  # Validate detection on a production machine without changing settings\n")
+	fmt.Printf("  %s --install --dryrun --gateway=192.168.1.1\n", os.Args[0])
+	fmt.Printf("  # Disable proxy on the corporate gateway, enable everywhere else\n")
+	fmt.Printf("  %s --install --invert --gateway=192.168.1.1\n", os.Args[0])
+	fmt.Printf("  # Enable proxy only during business hours\n")
+	fmt.Printf("  %s --install --gateway=192.168.1.1 --hours=08:00-18:00 --days=Mon-Fri\n", os.Args[0])
+	fmt.Printf("  # Change the gateway of an installed service\n")
+	fmt.Printf("  %s --reinstall --gateway=192.168.0.1\n", os.Args[0])
+	fmt.Printf("  # Machine-wide service that configures every logged-on user\n")
+	fmt.Printf("  %s --install --gateway=192.168.1.1 --all-sessions\n", os.Args[0])
+	fmt.Printf("  # Apply once from a Group Policy logon script\n")
+	fmt.Printf("  %s --apply --gateway=192.168.1.1\n", os.Args[0])
+	fmt.Printf("  # Read the override list from a file\n")
+	fmt.Printf("  %s --install --override=@C:\\ESPD\\override.txt\n", os.Args[0])
+	fmt.Printf("  # Validate a configuration file before deployment\n")
+	fmt.Printf("  %s --validate --config=espd.json\n", os.Args[0])
+	fmt.Printf("  # Save the current options for reuse with --config\n")
+	fmt.Printf("  %s --mode=both --findname=user --export-config=espd.json\n", os.Args[0])
+	fmt.Printf("  # Two sites with their own proxies; remove with --uninstall --profile=site1\n")
+	fmt.Printf("  %s --install --profile=site1 --gateway=192.168.1.1 --proxy=10.0.66.52:3128\n", os.Args[0])
+	fmt.Printf("  %s --install --profile=site2 --gateway=192.168.2.1 --proxy=10.0.77.10:3128\n", os.Args[0])
+	fmt.Printf("  # Test current username\n")
+	fmt.Printf("  %s --test --mode=user --fullname=DOMAIN\\username\n", os.Args[0])
+}
+
+// go mod init espв
+// go mod tidy
+// go run main.g
+// env GOOS=windows GOARCH=amd64 go build -o espd-proxy-service.exe
+// set GOOS=windows&& set GOARCH=amd64&& go build -o espd-proxy-service64.exe
+// set GOOS=windows&& set GOARCH=amd32&& go build -o espd-proxy-service32.exe
+// go build -ldflags "-X main.version=1.0.0 -X main.commit=%COMMIT% -X main.buildDate=%DATE%" -o espd-proxy-service64.exe
+//
+//Проверка по точному имени пользователя:
+//--install --mode=user --fullname="DOMAIN\username" --proxy=10.0.66.52:3128
+//Проверка по частичному имени:
+//--install --mode=user --findname="admin" --proxy=10.0.66.52:3128
+//Комбинированная проверка:
+//--install --mode=both --gateway=192.168.1.1 --findname="user" --proxy=10.0.66.52:3128
+//Тестирование пользователя:
+//--test --mode=user --fullname="DOMAIN\username"
+//Только шлюз (как раньше):
+//--install --mode=gateway --gateway=192.168.1.1
+//Проверка действий восстановления после установки:
+//sc qfailure ESPDProxyService
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestServiceBinPathRoundTrip(t *testing.T) {
+	savedCfg, savedLogPath := cfg, logPathFlag
+	defer func() { cfg, logPathFlag = savedCfg, savedLogPath }()
+
+	const exePath = `C:\Program Files\ESPD\espd-proxy-service.exe`
+	tests := []struct {
+		name string
+		set  func()
+	}{
+		{"spaces", func() {
+			cfg.FullUserName = `DOMAIN\Ivan Petrov;DOMAIN\svc espd`
+			cfg.ExcludeFindName = "test user"
+		}},
+		{"quotes", func() {
+			cfg.CheckCommand = `"C:\Program Files\ESPD\check.cmd" --site "main office"`
+			cfg.Override = `"quoted";<local>`
+		}},
+		{"trailing backslashes", func() {
+			logPathFlag = `C:\ESPD Logs\`
+			cfg.Group = `DOMAIN\`
+			cfg.ProxyUser = `DOMAIN\\`
+		}},
+		{"backslashes before quotes", func() {
+			cfg.NameRegex = `^svc\\"espd\"$`
+			cfg.InterfaceExclude = `VPN \"x\\"`
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, logPathFlag = savedCfg, savedLogPath
+			tt.set()
+
+			args := buildServiceArgs()
+			want := append([]string{exePath}, args...)
+
+			// Строка --print-binpath и строка, которую собирает mgr.CreateService
+			mgrPath := syscall.EscapeArg(exePath)
+			for _, arg := range args {
+				mgrPath += " " + syscall.EscapeArg(arg)
+			}
+
+			for _, binPath := range []string{serviceBinPath(exePath), mgrPath} {
+				got, err := windows.DecomposeCommandLine(binPath)
+				if err != nil {
+					t.Fatalf("DecomposeCommandLine(%q) error = %v", binPath, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("DecomposeCommandLine(%q) =\n%q\nwant\n%q", binPath, got, want)
+				}
+			}
+		})
+	}
+}
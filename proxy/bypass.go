@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxSubnetPatterns ограничивает число масок на одну подсеть: /20 даёт
+// 16 масок вида a.b.c.*, более широкая подсеть заменяется маской a.b.*
+const maxSubnetPatterns = 16
+
+// SubnetPatterns переводит подсеть в маски ProxyOverride. WinINET понимает
+// только '*' вместо целых октетов, поэтому длина префикса округляется до
+// октета: внутри /17-/24 перечисляются маски a.b.c.*, для /9-/16 - a.b.*
+func SubnetPatterns(subnet *net.IPNet) []string {
+	ones, _ := subnet.Mask.Size()
+	ip := subnet.IP.To4()
+	octets := func(ip net.IP, n int) string {
+		parts := make([]string, 0, 4)
+		for i := 0; i < n; i++ {
+			parts = append(parts, fmt.Sprint(ip[i]))
+		}
+		for i := n; i < 4; i++ {
+			parts = append(parts, "*")
+		}
+		return strings.Join(parts, ".")
+	}
+
+	switch {
+	case ones >= 32:
+		return []string{ip.String()}
+	case ones > 24:
+		return []string{octets(ip, 3)}
+	case ones == 24, ones == 16, ones == 8:
+		return []string{octets(ip, ones/8)}
+	case ones < 8:
+		// Не отключаем прокси для всего адресного пространства
+		return nil
+	}
+
+	// Префикс между октетами: маски следующего октета, если их немного
+	boundary := (ones/8 + 1) * 8
+	count := 1 << (boundary - ones)
+	if count > maxSubnetPatterns {
+		return []string{octets(ip, ones/8)}
+	}
+
+	base := binary.BigEndian.Uint32(ip)
+	step := uint32(1) << (32 - boundary)
+	var patterns []string
+	for i := 0; i < count; i++ {
+		next := make(net.IP, 4)
+		binary.BigEndian.PutUint32(next, base+uint32(i)*step)
+		patterns = append(patterns, octets(next, boundary/8))
+	}
+	return patterns
+}
+
+// localBypassPatterns возвращает маски подсетей машины для AutoLocalBypass
+func (c *Config) localBypassPatterns() []string {
+	subnets, err := LocalSubnets()
+	if err != nil {
+		c.logWarn(fmt.Sprintf("Cannot detect local subnets: %v", err))
+		return nil
+	}
+
+	var patterns []string
+	for _, subnet := range subnets {
+		patterns = append(patterns, SubnetPatterns(subnet)...)
+	}
+	return patterns
+}
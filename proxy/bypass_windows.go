@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// LocalSubnets возвращает IPv4-подсети подключённых адаптеров
+// (адрес и OnLinkPrefixLength), без loopback и APIPA
+func LocalSubnets() ([]*net.IPNet, error) {
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []*net.IPNet
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp || aa.IfType == windows.IF_TYPE_SOFTWARE_LOOPBACK {
+			continue
+		}
+		for addr := aa.FirstUnicastAddress; addr != nil; addr = addr.Next {
+			ip := addr.Address.IP().To4()
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			mask := net.CIDRMask(int(addr.OnLinkPrefixLength), 32)
+			subnets = append(subnets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+		}
+	}
+	return subnets, nil
+}
@@ -0,0 +1,448 @@
+// Package proxy содержит проверки условий (шлюз, пользователь, сеть) и
+// управление настройками прокси WinINET. Используется службой ESPD и может
+// подключаться из других инструментов
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+	originalSettingsKey = `Software\ESPDProxyService\OriginalSettings`
+	retryBaseDelay      = 1 * time.Second
+	failoverTimeout     = 2 * time.Second
+
+	// Сколько ждать команду обновления настроек в сеансе пользователя
+	sessionRefreshTimeout = 10 * time.Second
+
+	// Сколько ждать закрытия вывода команды --check-command после её завершения
+	checkWaitDelay = 2 * time.Second
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Logger получает диагностические сообщения пакета. fields - дополнительные
+// поля записи (например user), может быть nil
+type Logger interface {
+	Log(level LogLevel, message string, fields map[string]string)
+}
+
+// Config описывает условия включения прокси и записываемые настройки.
+// Перед использованием нужно вызвать CompileNameRegex, CompileUserPatterns,
+// CompileVPNPattern и ParseSchedule
+type Config struct {
+	Mode    string
+	Gateway string
+	Retries int
+
+	// Шлюзы площадок с метками "site1=10.0.1.1;site2=10.0.2.1", заменяют Gateway
+	GatewaySites string
+
+	// Имя или индекс интерфейса, на котором должен быть найден Gateway
+	GatewayIface string
+
+	// Проверять ICMP-ответ шлюза после совпадения адреса
+	PingCheck   bool
+	PingTimeout time.Duration
+
+	// Списки подстрок имени или описания адаптера через ';'
+	InterfaceInclude string
+	InterfaceExclude string
+
+	FullUserName  string
+	FindUserName  string
+	NameRegex     string
+	CaseSensitive bool
+	Group         string
+
+	// SID пользователя: точно или по префиксу с *, список через ';'
+	SID string
+
+	// Имя компьютера: точное совпадение и подстрока, списки через ';'
+	Hostname     string
+	HostnameFind string
+
+	// Пользователи, которым прокси не включается ни в одном режиме
+	ExcludeFullName string
+	ExcludeFindName string
+
+	SSID         string
+	DNSSuffix    string
+	DNSServer    string
+	GatewayMAC   string
+	ARPPing      bool
+	Probe        string
+	ProbeTimeout time.Duration
+
+	// Код опции DHCP режима dhcpoption и её ожидаемое значение
+	DHCPOption int
+	DHCPValue  string
+
+	// Команда режима script и время её ожидания
+	CheckCommand string
+	CheckTimeout time.Duration
+
+	// VPN - адаптер PPP/туннель или адаптер, имя или описание которого
+	// совпадает с VPNPattern (по умолчанию DefaultVPNPattern)
+	VPNPattern  string
+	VPNForcesOn bool
+
+	// На тарифицируемом подключении (сотовая связь) прокси не включается
+	SkipMetered bool
+
+	Invert bool
+	Hours  string
+	Days   string
+
+	Server   string
+	HTTP     string
+	HTTPS    string
+	FTP      string
+	Override string
+
+	// Домены (*.intranet.local) без прокси, добавляются к Override, см. ProxyOverride
+	BypassDomains string
+
+	// Добавлять к ProxyOverride маски собственных подсетей машины
+	AutoLocalBypass bool
+
+	ProxyUser     string
+	ProxyPassword string
+
+	WinHTTP   bool
+	NoRefresh bool
+
+	// Прописывать прокси и в machine.config установленных .NET Framework
+	DotNet bool
+
+	// Записывать настройки всем пользователям активных и отключённых сеансов
+	// (служба от LocalSystem), а не в HKCU текущей учётной записи. Условия
+	// на пользователя проверяются для каждого из них отдельно
+	AllSessions bool
+
+	// Команда, которую при AllSessions служба запускает в сеансе каждого
+	// пользователя от его имени, чтобы WinINET перечитал настройки:
+	// уведомление из сеанса 0 до приложений пользователей не доходит
+	SessionRefreshCommand []string
+
+	// Не сохранять исходную настройку пользователя: при выключении
+	// просто записывается ProxyEnable=0
+	NoRestore bool
+
+	// Менять только ProxyServer/ProxyOverride, не трогая ProxyEnable
+	ServerOnly bool
+
+	// Писать настройки и в ключи групповой политики, которые иначе
+	// перекрывают HKCU
+	GPO bool
+
+	Logger Logger
+
+	// Источники данных для проверок; nil - системные (Windows) реализации
+	Gateways GatewayProvider
+	Users    UserProvider
+	Store    ProxyStore
+
+	userNameRegex *regexp.Regexp
+	userPatterns  map[string]*regexp.Regexp
+	vpnRegex      *regexp.Regexp
+	activeWindow  *schedule
+	activeServer  string
+	policyWarned  bool
+
+	// Решения по SID пользователей сеансов последнего Evaluate
+	sessionDecisions map[string]bool
+
+	// Последний успешный способ определения шлюза, см. noteGatewayMethod
+	gatewayMethods map[string]string
+}
+
+func (c *Config) log(level LogLevel, message string, fields map[string]string) {
+	if c.Logger != nil {
+		c.Logger.Log(level, message, fields)
+	}
+}
+
+func (c *Config) logDebug(message string) {
+	c.log(LevelDebug, message, nil)
+}
+
+func (c *Config) logInfo(message string) {
+	c.log(LevelInfo, message, nil)
+}
+
+func (c *Config) logWarn(message string) {
+	c.log(LevelWarn, message, nil)
+}
+
+var ValidModes = []string{"gateway", "user", "group", "ssid", "dnssuffix", "reachable", "gatewaymac", "vpn", "script", "hostname", "dhcpoption", "dns", "sid", "both"}
+
+var overrideEntryPattern = regexp.MustCompile(`^(<local>|[A-Za-z0-9.*_\-:\[\]]+)$`)
+
+// bypassDomainPattern - имя домена, допускается маска *. в начале
+var bypassDomainPattern = regexp.MustCompile(`^(\*\.)?[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+func (c *Config) ValidateMode() error {
+	for _, mode := range ValidModes {
+		if c.Mode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown check mode %q, expected one of: %s", c.Mode, strings.Join(ValidModes, ", "))
+}
+
+func (c *Config) ValidateGateway() error {
+	if c.GatewaySites != "" {
+		_, err := c.Sites()
+		return err
+	}
+	if c.Gateway == AutoGateway {
+		return nil
+	}
+	return ValidateGatewayPattern(c.Gateway)
+}
+
+func (c *Config) ValidateOverride() error {
+	for _, entry := range strings.Split(c.Override, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !overrideEntryPattern.MatchString(entry) {
+			return fmt.Errorf("invalid override entry %q", entry)
+		}
+	}
+
+	for _, domain := range splitList(c.BypassDomains) {
+		if !bypassDomainPattern.MatchString(domain) {
+			return fmt.Errorf("invalid bypass domain %q, expected e.g. *.intranet.local", domain)
+		}
+	}
+	return nil
+}
+
+// ProxyOverride возвращает значение ProxyOverride: Override, BypassDomains
+// и при AutoLocalBypass маски локальных подсетей через ';' без повторов.
+// WinINET принимает маски доменов в том же списке, что и маски IP.
+// Домены вставляются перед <local>, сам <local> сохраняется
+func (c *Config) ProxyOverride() string {
+	var entries []string
+	seen := make(map[string]bool)
+	local := false
+	add := func(entry string) {
+		entry = strings.TrimSpace(entry)
+		key := strings.ToLower(entry)
+		if entry == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		if key == "<local>" {
+			local = true
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range strings.Split(c.Override, ";") {
+		add(entry)
+	}
+	for _, domain := range splitList(c.BypassDomains) {
+		add(domain)
+	}
+	if c.AutoLocalBypass {
+		for _, pattern := range c.localBypassPatterns() {
+			add(pattern)
+		}
+	}
+	if local {
+		entries = append(entries, "<local>")
+	}
+	return strings.Join(entries, ";")
+}
+
+func ValidateProxyAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid proxy address %q: %v", addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid proxy address %q: empty host", addr)
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid proxy address %q: port is not a number", addr)
+	}
+	if portNum < 1 || portNum > 65535 {
+		return fmt.Errorf("invalid proxy address %q: port %d out of range 1-65535", addr, portNum)
+	}
+
+	return nil
+}
+
+// ValidateProxy проверяет все адреса прокси, которые попадут в ProxyServer
+func (c *Config) ValidateProxy() error {
+	if c.HTTP == "" && c.HTTPS == "" && c.FTP == "" {
+		for _, addr := range c.ServerCandidates() {
+			if err := ValidateProxyAddress(addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, addr := range []string{c.HTTP, c.HTTPS, c.FTP} {
+		if addr == "" {
+			continue
+		}
+		if err := ValidateProxyAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ProxyAddresses возвращает адреса host:port, которые попадут в ProxyServer
+func (c *Config) ProxyAddresses() []string {
+	if c.HTTP == "" && c.HTTPS == "" && c.FTP == "" {
+		return []string{c.server()}
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, addr := range []string{c.HTTP, c.HTTPS, c.FTP} {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// ProxyServer собирает значение ProxyServer: при заданных протокольных
+// прокси используется формат http=...;https=...;ftp=..., иначе выбранный
+// из Server адрес (см. SelectServer).
+// С ProxyUser адреса записываются как user:pass@host:port. WinINET передаёт
+// их как есть, поэтому это помогает только с прокси и клиентами, которые
+// принимают учётные данные в адресе - обычно используется встроенная
+// проверка подлинности NTLM/Kerberos
+func (c *Config) ProxyServer() string {
+	return c.proxyServerFor(c.server(), true)
+}
+
+// winHTTPProxyServer - ProxyServer без user:pass@: WinHTTP учётные данные
+// из адреса не использует, а командную строку netsh видят другие процессы
+func (c *Config) winHTTPProxyServer() string {
+	return c.proxyServerFor(c.server(), false)
+}
+
+func (c *Config) proxyServerFor(server string, credentials bool) string {
+	withAuth := func(addr string) string {
+		if c.ProxyUser == "" || !credentials {
+			return addr
+		}
+		if c.ProxyPassword == "" {
+			return url.User(c.ProxyUser).String() + "@" + addr
+		}
+		return url.UserPassword(c.ProxyUser, c.ProxyPassword).String() + "@" + addr
+	}
+
+	var parts []string
+	if c.HTTP != "" {
+		parts = append(parts, "http="+withAuth(c.HTTP))
+	}
+	if c.HTTPS != "" {
+		parts = append(parts, "https="+withAuth(c.HTTPS))
+	}
+	if c.FTP != "" {
+		parts = append(parts, "ftp="+withAuth(c.FTP))
+	}
+
+	if len(parts) == 0 {
+		return withAuth(server)
+	}
+	return strings.Join(parts, ";")
+}
+
+// MaskedProxyServer возвращает ProxyServer со скрытым паролем для логов и вывода
+func (c *Config) MaskedProxyServer() string {
+	return MaskCredentials(c.ProxyServer())
+}
+
+// url.UserPassword экранирует ':' и '@' в пароле, поэтому пароль - это
+// всё между двоеточием и ближайшим '@'
+var credentialsPattern = regexp.MustCompile(`:[^:@]*@`)
+
+// MaskCredentials скрывает пароль в значении ProxyServer
+func MaskCredentials(server string) string {
+	return credentialsPattern.ReplaceAllString(server, ":***@")
+}
+
+func (c *Config) CompileNameRegex() error {
+	c.userNameRegex = nil
+	if c.NameRegex == "" {
+		return nil
+	}
+
+	pattern := c.NameRegex
+	if !c.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid --nameregex %q: %v", c.NameRegex, err)
+	}
+	c.userNameRegex = re
+	return nil
+}
+
+// CompileUserPatterns компилирует шаблоны с * и ? из FullUserName,
+// FindUserName, ExcludeFullName и ExcludeFindName, чтобы не делать этого
+// при каждом сравнении имени
+func (c *Config) CompileUserPatterns() error {
+	c.userPatterns = make(map[string]*regexp.Regexp)
+	lists := []struct {
+		value    string
+		anchored bool
+	}{
+		{c.FullUserName, true},
+		{c.FindUserName, false},
+		{c.ExcludeFullName, true},
+		{c.ExcludeFindName, false},
+	}
+	for _, list := range lists {
+		for _, pattern := range splitList(list.value) {
+			if !isWildcard(pattern) {
+				continue
+			}
+			expr := c.wildcardExpr(pattern, list.anchored)
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("invalid username pattern %q: %v", pattern, err)
+			}
+			c.userPatterns[expr] = re
+		}
+	}
+	return nil
+}
+
+// HasSchedule сообщает, ограничено ли включение прокси расписанием
+func (c *Config) HasSchedule() bool {
+	return c.activeWindow != nil
+}
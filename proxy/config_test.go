@@ -0,0 +1,19 @@
+package proxy
+
+import "testing"
+
+func TestWinHTTPProxyServerHasNoCredentials(t *testing.T) {
+	c := &Config{
+		Server:        "10.0.66.52:3128",
+		HTTPS:         "10.0.66.53:3129",
+		ProxyUser:     `ESPD\svc_proxy`,
+		ProxyPassword: "p@ss:word",
+	}
+
+	if got, want := c.winHTTPProxyServer(), "https=10.0.66.53:3129"; got != want {
+		t.Errorf("winHTTPProxyServer() = %q, want %q", got, want)
+	}
+	if got, want := c.ProxyServer(), "https="+`ESPD%5Csvc_proxy:p%40ss%3Aword@10.0.66.53:3129`; got != want {
+		t.Errorf("ProxyServer() = %q, want %q", got, want)
+	}
+}
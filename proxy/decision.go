@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Decision описывает результат проверки условий и причину решения
+type Decision struct {
+	Enable         bool   `json:"enable"`
+	GatewayMatched bool   `json:"gateway_matched"`
+	UserMatched    bool   `json:"user_matched"`
+	Site           string `json:"site,omitempty"`
+	Reason         string `json:"reason"`
+
+	// Решения по пользователям сеансов при AllSessions, см. evaluateSessions
+	Sessions []SessionDecision `json:"sessions,omitempty"`
+}
+
+// SessionDecision - решение для пользователя одного сеанса
+type SessionDecision struct {
+	SID    string `json:"sid"`
+	User   string `json:"user,omitempty"`
+	Enable bool   `json:"enable"`
+	Reason string `json:"reason"`
+}
+
+func matchDescription(name string, matched bool) string {
+	if matched {
+		return name + " matched"
+	}
+	return name + " did not match"
+}
+
+// optionalCheck - дополнительное условие режима both, учитывается только если задано
+type optionalCheck struct {
+	name    string
+	enabled bool
+	check   func() (bool, error)
+}
+
+func (c *Config) bothOptionalChecks() []optionalCheck {
+	return []optionalCheck{
+		{"user SID " + c.SID, c.SID != "", c.CheckSID},
+		{"SSID " + c.SSID, c.SSID != "", c.CheckSSID},
+		{"DNS suffix " + c.DNSSuffix, c.DNSSuffix != "", c.CheckDNSSuffix},
+		{"DNS server " + c.DNSServer, c.DNSServer != "", c.CheckDNSServer},
+		{"probe " + c.Probe, c.Probe != "", c.ProbeReachable},
+		{"gateway MAC " + c.GatewayMAC, c.GatewayMAC != "", c.CheckGatewayMAC},
+	}
+}
+
+// Evaluate проверяет условия режима Mode и возвращает решение с учётом
+// Invert, VPNForcesOn, SkipMetered, исключённых пользователей и расписания
+func (c *Config) Evaluate() (Decision, error) {
+	c.sessionDecisions = nil
+	if c.perSessionIdentity() {
+		return c.evaluateSessions()
+	}
+	return c.evaluate()
+}
+
+// perSessionIdentity сообщает, проверять ли при AllSessions каждого
+// пользователя отдельно: иначе условия на имя, группу и SID проверялись бы
+// по учётной записи службы (LocalSystem)
+func (c *Config) perSessionIdentity() bool {
+	if !c.AllSessions || c.Users != nil {
+		return false
+	}
+	switch c.Mode {
+	case "user", "group", "sid", "both":
+		return true
+	}
+	return c.HasExclusions()
+}
+
+// sessionEnabled возвращает, включать ли прокси пользователю sid при
+// общем решении enable. ok=false - сеанс появился после проверки
+func (c *Config) sessionEnabled(sid string, enable bool) (userEnable, ok bool) {
+	if c.sessionDecisions == nil || !enable {
+		return enable, true
+	}
+	userEnable, ok = c.sessionDecisions[sid]
+	return userEnable, ok
+}
+
+func (c *Config) evaluate() (Decision, error) {
+	var decision Decision
+
+	switch c.Mode {
+	case "gateway":
+		site, gatewayOk, err := c.GatewayMatch()
+		if err != nil {
+			return decision, err
+		}
+		decision.GatewayMatched = gatewayOk
+		decision.Site = site.Label
+		decision.Enable = gatewayOk
+		decision.Reason = matchDescription(c.gatewayDescription(site), gatewayOk)
+	case "user":
+		userOk, err := c.CheckUser()
+		if err != nil {
+			return decision, err
+		}
+		decision.UserMatched = userOk
+		decision.Enable = userOk
+		decision.Reason = matchDescription("user", userOk)
+	case "group":
+		groupOk, err := c.CheckGroup()
+		if err != nil {
+			return decision, err
+		}
+		decision.UserMatched = groupOk
+		decision.Enable = groupOk
+		decision.Reason = matchDescription("group "+c.Group, groupOk)
+	case "sid":
+		if c.SID == "" {
+			return decision, fmt.Errorf("mode sid requires --sid")
+		}
+		sidOk, err := c.CheckSID()
+		if err != nil {
+			return decision, err
+		}
+		decision.UserMatched = sidOk
+		decision.Enable = sidOk
+		decision.Reason = matchDescription("user SID", sidOk)
+	case "ssid":
+		ssidOk, err := c.CheckSSID()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = ssidOk
+		decision.Reason = matchDescription("SSID "+c.SSID, ssidOk)
+	case "dnssuffix":
+		suffixOk, err := c.CheckDNSSuffix()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = suffixOk
+		decision.Reason = matchDescription("DNS suffix "+c.DNSSuffix, suffixOk)
+	case "dns":
+		dnsOk, err := c.CheckDNSServer()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = dnsOk
+		decision.Reason = matchDescription("DNS server "+c.DNSServer, dnsOk)
+	case "reachable":
+		if c.Probe == "" {
+			return decision, fmt.Errorf("mode reachable requires --probe host:port")
+		}
+		reachable, err := c.ProbeReachable()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = reachable
+		if reachable {
+			decision.Reason = "probe " + c.Probe + " reachable"
+		} else {
+			decision.Reason = "probe " + c.Probe + " unreachable"
+		}
+	case "gatewaymac":
+		macOk, err := c.CheckGatewayMAC()
+		if err != nil {
+			return decision, err
+		}
+		decision.GatewayMatched = macOk
+		decision.Enable = macOk
+		decision.Reason = matchDescription("gateway MAC "+c.GatewayMAC, macOk)
+	case "vpn":
+		vpnOk, err := c.CheckVPN()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = vpnOk
+		decision.Reason = matchDescription("VPN", vpnOk)
+	case "hostname":
+		if c.Hostname == "" && c.HostnameFind == "" {
+			return decision, fmt.Errorf("mode hostname requires --hostname or --hostname-find")
+		}
+		hostOk, err := c.CheckHostname()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = hostOk
+		decision.Reason = matchDescription("computer name", hostOk)
+	case "dhcpoption":
+		dhcpOk, err := c.CheckDHCPOption()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = dhcpOk
+		decision.Reason = matchDescription(fmt.Sprintf("DHCP option %d", c.DHCPOption), dhcpOk)
+	case "script":
+		scriptOk, err := c.RunCheckCommand()
+		if err != nil {
+			return decision, err
+		}
+		decision.Enable = scriptOk
+		if scriptOk {
+			decision.Reason = "check command returned 0"
+		} else {
+			decision.Reason = "check command returned non-zero"
+		}
+	case "both":
+		site, gatewayOk, err := c.GatewayMatch()
+		if err != nil {
+			return decision, err
+		}
+		decision.Site = site.Label
+		userOk, err := c.checkIdentity()
+		if err != nil {
+			return decision, err
+		}
+		decision.GatewayMatched = gatewayOk
+		decision.UserMatched = userOk
+		decision.Enable = gatewayOk && userOk
+		reasons := []string{
+			matchDescription(c.gatewayDescription(site), gatewayOk),
+			matchDescription("user", userOk),
+		}
+
+		for _, optional := range c.bothOptionalChecks() {
+			if !optional.enabled {
+				continue
+			}
+			ok, err := optional.check()
+			if err != nil {
+				return decision, err
+			}
+			decision.Enable = decision.Enable && ok
+			reasons = append(reasons, matchDescription(optional.name, ok))
+		}
+
+		decision.Reason = strings.Join(reasons, ", ")
+	default:
+		return decision, fmt.Errorf("unknown check mode: %s", c.Mode)
+	}
+
+	// Invert: прокси включается, когда условия НЕ выполнены
+	if c.Invert {
+		decision.Enable = !decision.Enable
+		decision.Reason += " (inverted)"
+	}
+
+	// С VPNForcesOn активный VPN включает прокси при любом шлюзе
+	if c.VPNForcesOn && c.Mode != "vpn" && !decision.Enable {
+		vpnOk, err := c.CheckVPN()
+		if err != nil {
+			return decision, err
+		}
+		if vpnOk {
+			decision.Enable = true
+			decision.Reason += ", VPN active"
+		}
+	}
+
+	// SkipMetered выключает прокси на тарифицируемом подключении при любом шлюзе
+	if c.SkipMetered && decision.Enable {
+		metered, err := c.IsMetered()
+		if err != nil {
+			return decision, err
+		}
+		if metered {
+			c.logInfo("Metered connection, disabling proxy")
+			decision.Enable = false
+			decision.Reason += ", metered connection"
+		}
+	}
+
+	// Исключённым пользователям прокси не включается, даже при совпадении шлюза
+	if c.HasExclusions() {
+		excluded, rule, err := c.CheckExcluded()
+		if err != nil {
+			return decision, err
+		}
+		if excluded {
+			if decision.Enable {
+				c.logInfo(fmt.Sprintf("User matched %s, disabling proxy", rule))
+			}
+			decision.Enable = false
+			decision.Reason += ", " + rule
+		}
+	}
+
+	// Вне расписания прокси выключается независимо от остальных условий
+	if c.activeWindow != nil && !c.activeWindow.contains(time.Now()) {
+		if decision.Enable {
+			c.logInfo("Outside of schedule window, disabling proxy")
+		}
+		decision.Enable = false
+		decision.Reason += ", outside schedule"
+	}
+
+	return decision, nil
+}
+
+func (c *Config) ShouldEnableProxy() (bool, error) {
+	decision, err := c.Evaluate()
+	if err != nil {
+		return false, err
+	}
+	return decision.Enable, nil
+}
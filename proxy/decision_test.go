@@ -0,0 +1,120 @@
+package proxy
+
+import "testing"
+
+// fakeGateways - GatewayProvider с заданным шлюзом по умолчанию
+type fakeGateways struct{ gateway string }
+
+func (g fakeGateways) DefaultGateway() (string, error)   { return g.gateway, nil }
+func (g fakeGateways) ActiveGateways() ([]string, error) { return []string{g.gateway}, nil }
+func (g fakeGateways) AdapterGateways() ([]AdapterGateway, error) {
+	return []AdapterGateway{{Name: "Ethernet", Index: 1, Gateways: []string{g.gateway}}}, nil
+}
+
+// fakeUsers - UserProvider с заданной учётной записью
+type fakeUsers struct {
+	name   string
+	upn    string
+	groups []string
+	sid    string
+}
+
+func (u fakeUsers) CurrentUsername() (string, error)     { return u.name, nil }
+func (u fakeUsers) UserPrincipalName() (string, error)   { return u.upn, nil }
+func (u fakeUsers) CurrentUserGroups() ([]string, error) { return u.groups, nil }
+func (u fakeUsers) CurrentUserSID() (string, error)      { return u.sid, nil }
+
+func TestEvaluateDecisionMatrix(t *testing.T) {
+	const (
+		office = "192.168.1.1"
+		home   = "10.0.0.1"
+	)
+	employee := fakeUsers{name: `ESPD\ivanov`, upn: "ivanov@espd.ru", sid: "S-1-5-21-1-2-3-1001"}
+	guest := fakeUsers{name: `HOME-PC\guest`, sid: "S-1-5-21-4-5-6-1001"}
+
+	tests := []struct {
+		name    string
+		mode    string
+		gateway string
+		user    fakeUsers
+		invert  bool
+		enable  bool
+		gwOk    bool
+		userOk  bool
+	}{
+		{"gateway matched", "gateway", office, guest, false, true, true, false},
+		{"gateway not matched", "gateway", home, employee, false, false, false, false},
+		{"gateway matched, inverted", "gateway", office, guest, true, false, true, false},
+		{"user matched", "user", home, employee, false, true, false, true},
+		{"user not matched", "user", office, guest, false, false, false, false},
+		{"both matched", "both", office, employee, false, true, true, true},
+		{"both, only gateway matched", "both", office, guest, false, false, true, false},
+		{"both, only user matched", "both", home, employee, false, false, false, true},
+		{"both not matched", "both", home, guest, false, false, false, false},
+		{"both not matched, inverted", "both", home, guest, true, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Mode:         tt.mode,
+				Gateway:      office,
+				FullUserName: `ESPD\ivanov`,
+				Invert:       tt.invert,
+				Gateways:     fakeGateways{tt.gateway},
+				Users:        tt.user,
+			}
+
+			decision, err := c.Evaluate()
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if decision.Enable != tt.enable {
+				t.Errorf("Enable = %v, want %v (%s)", decision.Enable, tt.enable, decision.Reason)
+			}
+			if decision.GatewayMatched != tt.gwOk {
+				t.Errorf("GatewayMatched = %v, want %v", decision.GatewayMatched, tt.gwOk)
+			}
+			if decision.UserMatched != tt.userOk {
+				t.Errorf("UserMatched = %v, want %v", decision.UserMatched, tt.userOk)
+			}
+		})
+	}
+}
+
+func TestEvaluateUserChecksUPN(t *testing.T) {
+	c := &Config{
+		Mode:         "user",
+		FullUserName: "ivanov@espd.ru",
+		Users:        fakeUsers{name: `ESPD\ivanov`, upn: "ivanov@espd.ru"},
+	}
+
+	decision, err := c.Evaluate()
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if !decision.Enable {
+		t.Errorf("Enable = false, want true: UPN should match --fullname (%s)", decision.Reason)
+	}
+}
+
+func TestEvaluateExcludedUser(t *testing.T) {
+	c := &Config{
+		Mode:            "gateway",
+		Gateway:         "192.168.1.1",
+		ExcludeFindName: "svc_",
+		Gateways:        fakeGateways{"192.168.1.1"},
+		Users:           fakeUsers{name: `ESPD\svc_backup`},
+	}
+
+	decision, err := c.Evaluate()
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if decision.Enable {
+		t.Errorf("Enable = true, want false for an excluded user (%s)", decision.Reason)
+	}
+	if !decision.GatewayMatched {
+		t.Errorf("GatewayMatched = false, want true")
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// DHCPOption - значение опции из аренды одного адаптера
+type DHCPOption struct {
+	Adapter string
+	Data    []byte
+}
+
+// parseDHCPOptions разбирает DhcpInterfaceOptions - кэш опций последней
+// аренды. Формат не документирован: записи из четырёх DWORD (код опции,
+// признак vendor-опции, длина данных, время) и данных, выровненных до 4 байт
+func parseDHCPOptions(data []byte, code uint32) ([]byte, bool) {
+	for len(data) >= 16 {
+		optionCode := binary.LittleEndian.Uint32(data[0:4])
+		vendor := binary.LittleEndian.Uint32(data[4:8])
+		length := binary.LittleEndian.Uint32(data[8:12])
+		data = data[16:]
+
+		padded := (uint64(length) + 3) &^ 3
+		if uint64(len(data)) < uint64(length) {
+			return nil, false
+		}
+		if optionCode == code && vendor == 0 {
+			return data[:length], true
+		}
+		if uint64(len(data)) < padded {
+			return nil, false
+		}
+		data = data[padded:]
+	}
+	return nil, false
+}
+
+// dhcpValueMatches сравнивает опцию с ожидаемым значением как строку
+// (без учёта регистра и завершающих нулей) или как hex без разделителей
+func dhcpValueMatches(data []byte, expected string) bool {
+	text := strings.TrimRight(string(data), "\x00")
+	if strings.EqualFold(strings.TrimSpace(text), expected) {
+		return true
+	}
+	digits := strings.NewReplacer(":", "", "-", "", " ", "").Replace(expected)
+	return strings.EqualFold(hex.EncodeToString(data), digits)
+}
+
+func (c *Config) ValidateDHCPOption() error {
+	if c.Mode != "dhcpoption" {
+		return nil
+	}
+	if c.DHCPOption < 1 || c.DHCPOption > 254 {
+		return fmt.Errorf("mode dhcpoption requires --dhcp-option between 1 and 254")
+	}
+	if c.DHCPValue == "" {
+		return fmt.Errorf("mode dhcpoption requires --dhcp-value")
+	}
+	return nil
+}
+
+func (c *Config) CheckDHCPOption() (bool, error) {
+	if err := c.ValidateDHCPOption(); err != nil {
+		return false, err
+	}
+
+	options, err := DHCPOptionValues(c.DHCPOption)
+	if err != nil {
+		return false, err
+	}
+	if len(options) == 0 {
+		c.logDebug(fmt.Sprintf("No adapter has DHCP option %d in its lease", c.DHCPOption))
+		return false, nil
+	}
+
+	for _, option := range options {
+		if dhcpValueMatches(option.Data, c.DHCPValue) {
+			c.logInfo(fmt.Sprintf("DHCP option %d match on %s", c.DHCPOption, option.Adapter))
+			return true, nil
+		}
+		c.logDebug(fmt.Sprintf("DHCP option %d on %s is %x, does not match %s",
+			c.DHCPOption, option.Adapter, option.Data, c.DHCPValue))
+	}
+	return false, nil
+}
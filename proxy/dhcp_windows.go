@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const tcpipInterfacesKey = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces\`
+
+// DHCPOptionValues возвращает значение опции code из аренды каждого
+// подключённого адаптера, у которого она есть
+func DHCPOptionValues(code int) ([]DHCPOption, error) {
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var options []DHCPOption
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+
+		guid := windows.BytePtrToString(aa.AdapterName)
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, tcpipInterfacesKey+guid, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		cache, _, err := k.GetBinaryValue("DhcpInterfaceOptions")
+		k.Close()
+		if err != nil {
+			continue
+		}
+
+		if value, ok := parseDHCPOptions(cache, uint32(code)); ok {
+			options = append(options, DHCPOption{
+				Adapter: windows.UTF16PtrToString(aa.FriendlyName),
+				Data:    value,
+			})
+		}
+	}
+
+	return options, nil
+}
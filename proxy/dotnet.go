@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Блок, записанный службой, выделяется комментариями, чтобы при выключении
+// удалить только его и не трогать остальную конфигурацию
+const (
+	dotNetBeginMarker = "<!-- ESPDProxyService: begin -->"
+	dotNetEndMarker   = "<!-- ESPDProxyService: end -->"
+	dotNetBackupExt   = ".espd-backup"
+)
+
+var (
+	dotNetManagedBlock = regexp.MustCompile(`(?s)[ \t]*` + regexp.QuoteMeta(dotNetBeginMarker) + `.*?` + regexp.QuoteMeta(dotNetEndMarker) + `\r?\n?`)
+	dotNetSystemNet    = regexp.MustCompile(`<system\.net\s*>`)
+	dotNetConfigEnd    = regexp.MustCompile(`</configuration\s*>`)
+)
+
+// DotNetConfigFiles возвращает machine.config всех установленных версий
+// .NET Framework (32- и 64-разрядных)
+func DotNetConfigFiles() ([]string, error) {
+	windir := os.Getenv("WINDIR")
+	if windir == "" {
+		return nil, fmt.Errorf("WINDIR is not set")
+	}
+	return filepath.Glob(filepath.Join(windir, "Microsoft.NET", "Framework*", "v*", "Config", "machine.config"))
+}
+
+func xmlAttr(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// dotNetProxyAddress - адрес для defaultProxy: .NET принимает один прокси
+// без учётных данных, поэтому берётся HTTP (или HTTPS) адрес без user:pass@
+func (c *Config) dotNetProxyAddress() string {
+	addr := c.HTTP
+	if addr == "" {
+		addr = c.HTTPS
+	}
+	if addr == "" {
+		addr = c.server()
+	}
+	return "http://" + addr
+}
+
+// dotNetProxyBlock строит <defaultProxy>. Маски ProxyOverride переводятся
+// в регулярные выражения bypasslist, <local> - в bypassonlocal
+func (c *Config) dotNetProxyBlock(indent, newline string) string {
+	bypassLocal := "False"
+	var bypass []string
+	for _, entry := range strings.Split(c.ProxyOverride(), ";") {
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+		case "<local>":
+			bypassLocal = "True"
+		default:
+			pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(entry), `\*`, ".*") + "$"
+			bypass = append(bypass, pattern)
+		}
+	}
+
+	lines := []string{
+		`<defaultProxy enabled="true" useDefaultCredentials="true">`,
+		`  <proxy usesystemdefault="False" proxyaddress="` + xmlAttr(c.dotNetProxyAddress()) + `" bypassonlocal="` + bypassLocal + `" />`,
+	}
+	if len(bypass) > 0 {
+		lines = append(lines, "  <bypasslist>")
+		for _, pattern := range bypass {
+			lines = append(lines, `    <add address="`+xmlAttr(pattern)+`" />`)
+		}
+		lines = append(lines, "  </bypasslist>")
+	}
+	lines = append(lines, "</defaultProxy>")
+
+	for i := range lines {
+		lines[i] = indent + lines[i]
+	}
+	return strings.Join(lines, newline) + newline
+}
+
+// dotNetConfigContent возвращает содержимое machine.config с блоком прокси
+// (enable) или без него. Свой <system.net> добавляется перед </configuration>,
+// если в файле его ещё нет, иначе в существующий вписывается только defaultProxy
+func (c *Config) dotNetConfigContent(content string, enable bool) (string, error) {
+	content = dotNetManagedBlock.ReplaceAllString(content, "")
+	if !enable {
+		return content, nil
+	}
+
+	newline := "\n"
+	if strings.Contains(content, "\r\n") {
+		newline = "\r\n"
+	}
+
+	if loc := dotNetSystemNet.FindStringIndex(content); loc != nil {
+		section := content[loc[1]:]
+		if end := strings.Index(section, "</system.net>"); end >= 0 {
+			section = section[:end]
+		}
+		if strings.Contains(section, "<defaultProxy") {
+			return "", fmt.Errorf("<system.net> already contains a <defaultProxy> not managed by the service")
+		}
+		block := newline + "    " + dotNetBeginMarker + newline +
+			c.dotNetProxyBlock("    ", newline) +
+			"    " + dotNetEndMarker
+		return content[:loc[1]] + block + content[loc[1]:], nil
+	}
+
+	loc := dotNetConfigEnd.FindStringIndex(content)
+	if loc == nil {
+		return "", fmt.Errorf("</configuration> not found")
+	}
+	block := "  " + dotNetBeginMarker + newline +
+		"  <system.net>" + newline +
+		c.dotNetProxyBlock("    ", newline) +
+		"  </system.net>" + newline +
+		"  " + dotNetEndMarker + newline
+	return content[:loc[0]] + block + content[loc[0]:], nil
+}
+
+// backupFile один раз копирует исходный файл в path.espd-backup; существующая
+// копия не перезаписывается, чтобы в ней оставался оригинал
+func backupFile(path string, data []byte) error {
+	backup := path + dotNetBackupExt
+	if _, err := os.Stat(backup); err == nil {
+		return nil
+	}
+	return os.WriteFile(backup, data, 0644)
+}
+
+// setDotNetProxy записывает или удаляет defaultProxy в machine.config
+func (c *Config) setDotNetProxy(enable bool) error {
+	files, err := DotNetConfigFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		c.logDebug("No .NET Framework machine.config found")
+		return nil
+	}
+
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", path, err)
+		}
+		content, err := c.dotNetConfigContent(string(data), enable)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if content == string(data) {
+			continue
+		}
+
+		if err := backupFile(path, data); err != nil {
+			return fmt.Errorf("cannot back up %s: %v", path, err)
+		}
+		// Запись через временный файл: .NET не должен увидеть обрезанный конфиг
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+			return fmt.Errorf("cannot write %s: %v", tmp, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("cannot replace %s: %v", path, err)
+		}
+		c.logDebug(fmt.Sprintf(".NET proxy settings written to %s", path))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ServerCandidates возвращает адреса из Server в порядке приоритета.
+// Server может содержать несколько прокси через запятую: основной и резервные
+func (c *Config) ServerCandidates() []string {
+	var candidates []string
+	for _, addr := range strings.Split(c.Server, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+// server возвращает адрес, выбранный SelectServer, а до первого выбора -
+// первый из списка
+func (c *Config) server() string {
+	if c.activeServer != "" {
+		return c.activeServer
+	}
+	if candidates := c.ServerCandidates(); len(candidates) > 0 {
+		return candidates[0]
+	}
+	return c.Server
+}
+
+// SelectServer проверяет TCP-подключением адреса из Server по порядку и
+// выбирает первый доступный. Вызывается при каждом включении, поэтому после
+// восстановления основного прокси служба возвращается на него. Если не
+// отвечает ни один, остаётся первый из списка
+func (c *Config) SelectServer() string {
+	candidates := c.ServerCandidates()
+	if len(candidates) < 2 {
+		return c.server()
+	}
+
+	selected := candidates[0]
+	for _, addr := range candidates {
+		conn, err := net.DialTimeout("tcp", addr, failoverTimeout)
+		if err != nil {
+			c.logDebug(fmt.Sprintf("Proxy candidate %s is not reachable: %v", addr, err))
+			continue
+		}
+		conn.Close()
+		selected = addr
+		break
+	}
+
+	previous := c.server()
+	c.activeServer = selected
+	if selected != previous {
+		c.logWarn(fmt.Sprintf("Proxy failover: %s -> %s", previous, selected))
+	}
+	c.logDebug(fmt.Sprintf("Active proxy: %s", selected))
+	return selected
+}
+
+// OwnsServer сообщает, записан ли value службой - для любого из адресов Server
+func (c *Config) OwnsServer(value string) bool {
+	for _, addr := range c.ServerCandidates() {
+		if c.proxyServerFor(addr, true) == value {
+			return true
+		}
+	}
+	return value == c.ProxyServer()
+}
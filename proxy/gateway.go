@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GatewayActive сообщает, активен ли целевой шлюз. Шлюз определяется через
+// iphlpapi, а если это не удалось - через вывод route print и netsh
+func (c *Config) GatewayActive() (bool, error) {
+	_, active, err := c.GatewayMatch()
+	return active, err
+}
+
+// GatewayMatch определяет, активен ли один из целевых шлюзов, и возвращает
+// площадку совпавшего шлюза (см. Sites)
+func (c *Config) GatewayMatch() (Site, bool, error) {
+	if c.Gateway == AutoGateway && c.GatewaySites == "" {
+		return Site{}, false, fmt.Errorf("--gateway=auto is resolved only by --install and --reinstall")
+	}
+
+	attempts := c.Retries
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := retryBaseDelay
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var site Site
+		var active bool
+		site, active, err = c.detectGateway()
+		if err == nil {
+			if active && c.PingCheck {
+				return site, c.gatewayResponds(site.Gateway), nil
+			}
+			return site, active, nil
+		}
+
+		if attempt < attempts {
+			c.logWarn(fmt.Sprintf("Gateway detection failed (attempt %d of %d): %v, retrying in %s", attempt, attempts, err, delay))
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return Site{}, false, fmt.Errorf("gateway detection failed after %d attempts: %v", attempts, err)
+}
+
+// interfaceAllowed проверяет адаптер по InterfaceInclude и InterfaceExclude.
+// Сравнивается подстрока имени или описания без учёта регистра
+func (c *Config) interfaceAllowed(adapter AdapterGateway) bool {
+	matches := func(pattern string) bool {
+		pattern = strings.ToLower(pattern)
+		return strings.Contains(strings.ToLower(adapter.Name), pattern) ||
+			strings.Contains(strings.ToLower(adapter.Description), pattern)
+	}
+
+	for _, pattern := range splitList(c.InterfaceExclude) {
+		if matches(pattern) {
+			return false
+		}
+	}
+
+	include := splitList(c.InterfaceInclude)
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredAdapters возвращает только разрешённые адаптеры со шлюзами
+func (c *Config) filteredAdapters() ([]AdapterGateway, error) {
+	adapters, err := c.gateways().AdapterGateways()
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []AdapterGateway
+	ifaceFound := false
+	for _, adapter := range adapters {
+		if c.GatewayIface != "" && c.ifaceMatches(adapter) {
+			ifaceFound = true
+		}
+		if !c.interfaceAllowed(adapter) {
+			c.logDebug(fmt.Sprintf("Adapter %s (%s) filtered out", adapter.Name, adapter.Description))
+			continue
+		}
+		c.logDebug(fmt.Sprintf("Adapter %s (%s) considered, gateways [%s]",
+			adapter.Name, adapter.Description, strings.Join(adapter.Gateways, ", ")))
+		if len(adapter.Gateways) > 0 {
+			allowed = append(allowed, adapter)
+		}
+	}
+
+	// Опечатка в имени адаптера иначе выглядела бы как обычное "шлюз не найден":
+	// ошибка доходит до вызывающего и попадает в журнал событий через logError
+	if c.GatewayIface != "" && !ifaceFound {
+		return nil, fmt.Errorf("gateway adapter %q not found or not connected", c.GatewayIface)
+	}
+
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no active gateways on allowed adapters")
+	}
+	return allowed, nil
+}
+
+// ifaceMatches сравнивает адаптер с GatewayIface: число - индекс
+// интерфейса, иначе имя адаптера без учёта регистра
+func (c *Config) ifaceMatches(adapter AdapterGateway) bool {
+	if index, err := strconv.ParseUint(c.GatewayIface, 10, 32); err == nil {
+		return adapter.Index == uint32(index)
+	}
+	return strings.EqualFold(adapter.Name, c.GatewayIface)
+}
+
+// gatewayResponds отсеивает устаревшие записи маршрутов и ARP: адрес
+// совпал, но шлюз на самом деле недоступен (например, отключён кабель)
+func (c *Config) gatewayResponds(gateway string) bool {
+	if err := Ping(gateway, c.PingTimeout); err != nil {
+		c.logInfo(fmt.Sprintf("Gateway %s matched but does not respond: %v", gateway, err))
+		return false
+	}
+	c.logDebug(fmt.Sprintf("Gateway %s responds to ping", gateway))
+	return true
+}
+
+func (c *Config) detectGateway() (Site, bool, error) {
+	// С фильтром адаптеров таблица маршрутов не используется: маршрут
+	// по умолчанию может принадлежать исключённому адаптеру
+	if c.InterfaceInclude != "" || c.InterfaceExclude != "" || c.GatewayIface != "" {
+		adapters, err := c.filteredAdapters()
+		if err != nil {
+			return Site{}, false, err
+		}
+		for _, adapter := range adapters {
+			for _, gw := range adapter.Gateways {
+				site, ok := c.matchSite(gw)
+				if !ok {
+					continue
+				}
+				if c.GatewayIface != "" && !c.ifaceMatches(adapter) {
+					c.logDebug(fmt.Sprintf("Gateway %s found on interface %s (%d), expected %s",
+						gw, adapter.Name, adapter.Index, c.GatewayIface))
+					continue
+				}
+				c.logDebug(fmt.Sprintf("Gateway %s matched on interface %s (%d)", gw, adapter.Name, adapter.Index))
+				return site, true, nil
+			}
+		}
+		return Site{}, false, nil
+	}
+
+	defaultGateway, err := c.gateways().DefaultGateway()
+	if err != nil {
+		gateways, err := c.gateways().ActiveGateways()
+		if err != nil {
+			return Site{}, false, err
+		}
+
+		for _, gw := range gateways {
+			if site, ok := c.matchSite(gw); ok {
+				return site, true, nil
+			}
+		}
+
+		return Site{}, false, nil
+	}
+
+	site, ok := c.matchSite(defaultGateway)
+	return site, ok, nil
+}
+
+func NormalizeMAC(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(mac), ":", "-"))
+}
+
+// LookupGatewayMAC возвращает адрес шлюза по умолчанию и его MAC из таблицы ARP
+func (c *Config) LookupGatewayMAC() (string, string, error) {
+	gateway, err := c.gateways().DefaultGateway()
+	if err != nil {
+		gateways, err := c.gateways().ActiveGateways()
+		if err != nil {
+			return "", "", err
+		}
+		gateway = gateways[0]
+	}
+
+	mac, err := lookupARP(gateway)
+	if err != nil {
+		return gateway, "", err
+	}
+
+	// Запись ARP может ещё не появиться сразу после подключения
+	if mac == "" && c.ARPPing {
+		c.logDebug(fmt.Sprintf("No ARP entry for %s, pinging gateway", gateway))
+		exec.Command("ping", "-n", "1", "-w", "1000", gateway).Run()
+		mac, err = lookupARP(gateway)
+		if err != nil {
+			return gateway, "", err
+		}
+	}
+
+	if mac == "" {
+		return gateway, "", fmt.Errorf("no ARP entry for gateway %s", gateway)
+	}
+	return gateway, mac, nil
+}
+
+func (c *Config) CheckGatewayMAC() (bool, error) {
+	if c.GatewayMAC == "" {
+		return false, nil
+	}
+
+	gateway, mac, err := c.LookupGatewayMAC()
+	if err != nil {
+		return false, err
+	}
+
+	if mac == NormalizeMAC(c.GatewayMAC) {
+		c.logInfo(fmt.Sprintf("Gateway MAC match: %s (%s)", mac, gateway))
+		return true, nil
+	}
+
+	c.logDebug(fmt.Sprintf("Gateway %s MAC %s does not match %s", gateway, mac, c.GatewayMAC))
+	return false, nil
+}
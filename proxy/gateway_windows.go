@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Route - маршрут по умолчанию из таблицы маршрутизации
+type Route struct {
+	Gateway   string // On-link или 0.0.0.0 для маршрута через сам интерфейс
+	Interface string // адрес интерфейса
+	Metric    int
+}
+
+// Шаблоны разбора вывода route print и netsh компилируются один раз:
+// проверка выполняется каждую минуту
+
+// Network Destination, Netmask, Gateway, Interface, Metric. У постоянных
+// маршрутов вместо метрики "Default", они в выборку не попадают
+var defaultRoutePattern = regexp.MustCompile(`^\s*0\.0\.0\.0\s+0\.0\.0\.0\s+(\S+)\s+(\S+)\s+(\d+)\s*$`)
+
+// Строка шлюза в выводе netsh на английской и русской Windows
+var gatewayPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`Default Gateway[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
+	regexp.MustCompile(`Основной шлюз[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
+	regexp.MustCompile(`Шлюз, используемый по умолчанию[\. ]*: (\d+\.\d+\.\d+\.\d+)`),
+}
+
+// Способы определения шлюза: сначала API iphlpapi, route.exe и netsh.exe -
+// запасной путь (их запуск может быть запрещён AppLocker)
+const (
+	methodForwardTable    = "GetIpForwardTable"
+	methodAdapterAddress  = "GetAdaptersAddresses"
+	methodRoutePrint      = "route print"
+	methodNetshShowConfig = "netsh"
+)
+
+var procGetIpForwardTable = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("GetIpForwardTable")
+
+// mibIPForwardRow - MIB_IPFORWARDROW; адреса в сетевом порядке байт
+type mibIPForwardRow struct {
+	Dest, Mask, Policy, NextHop                 uint32
+	IfIndex, Type, Proto, Age, NextHopAS        uint32
+	Metric1, Metric2, Metric3, Metric4, Metric5 uint32
+}
+
+func ipv4FromDWORD(v uint32) string {
+	return net.IPv4(byte(v), byte(v>>8), byte(v>>16), byte(v>>24)).String()
+}
+
+// forwardTableRoutes возвращает маршруты 0.0.0.0/0 через GetIpForwardTable.
+// Metric1 в Windows Vista и новее - сумма метрик маршрута и интерфейса, как в
+// route print; интерфейс определяется по индексу через GetAdaptersAddresses
+func forwardTableRoutes() ([]Route, error) {
+	size := uint32(0)
+	var buf []byte
+	for {
+		var ptr uintptr
+		if len(buf) > 0 {
+			ptr = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		ret, _, _ := procGetIpForwardTable.Call(ptr, uintptr(unsafe.Pointer(&size)), 0)
+		if ret == 0 {
+			break
+		}
+		if windows.Errno(ret) != windows.ERROR_INSUFFICIENT_BUFFER {
+			return nil, fmt.Errorf("GetIpForwardTable failed: %v", windows.Errno(ret))
+		}
+		buf = make([]byte, size)
+	}
+	if len(buf) < 4 {
+		return nil, nil
+	}
+
+	addresses := make(map[uint32]string)
+	if adapters, err := AdapterAddresses(); err == nil {
+		for _, aa := range adapters {
+			if aa.FirstUnicastAddress != nil {
+				if ip := aa.FirstUnicastAddress.Address.IP(); ip != nil {
+					addresses[aa.IfIndex] = ip.String()
+				}
+			}
+		}
+	}
+
+	count := *(*uint32)(unsafe.Pointer(&buf[0]))
+	rows := unsafe.Slice((*mibIPForwardRow)(unsafe.Pointer(&buf[4])), count)
+
+	var routes []Route
+	for _, row := range rows {
+		if row.Dest != 0 || row.Mask != 0 {
+			continue
+		}
+		routes = append(routes, Route{
+			Gateway:   ipv4FromDWORD(row.NextHop),
+			Interface: addresses[row.IfIndex],
+			Metric:    int(row.Metric1),
+		})
+	}
+	return routes, nil
+}
+
+// DefaultRoutes возвращает все активные маршруты 0.0.0.0/0
+func DefaultRoutes() ([]Route, error) {
+	routes, _, err := defaultRoutes()
+	return routes, err
+}
+
+// defaultRoutes возвращает маршруты и способ, которым они получены
+func defaultRoutes() ([]Route, string, error) {
+	routes, apiErr := forwardTableRoutes()
+	if apiErr == nil {
+		return routes, methodForwardTable, nil
+	}
+	routes, err := routePrintRoutes()
+	if err != nil {
+		return nil, "", fmt.Errorf("%v; %v", apiErr, err)
+	}
+	return routes, methodRoutePrint, nil
+}
+
+// routePrintRoutes разбирает маршруты 0.0.0.0/0 из вывода route print
+func routePrintRoutes() ([]Route, error) {
+	cmd := exec.Command("route", "print", "-4")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("route print failed: %v", err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+
+	var routes []Route
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := defaultRoutePattern.FindStringSubmatch(line); matches != nil && len(matches) > 3 {
+			metric, err := strconv.Atoi(matches[3])
+			if err != nil {
+				continue
+			}
+			routes = append(routes, Route{Gateway: matches[1], Interface: matches[2], Metric: metric})
+		}
+	}
+
+	return routes, nil
+}
+
+// HasGateway сообщает, указан ли у маршрута адрес шлюза. У маршрута через
+// сам интерфейс (VPN, PPP) вместо шлюза указано On-link или 0.0.0.0
+func (r Route) HasGateway() bool {
+	ip := net.ParseIP(r.Gateway)
+	return ip != nil && !ip.IsUnspecified()
+}
+
+func DefaultGateway() (string, error) {
+	gateway, _, err := defaultGateway()
+	return gateway, err
+}
+
+func defaultGateway() (string, string, error) {
+	routes, method, err := defaultRoutes()
+	if err != nil {
+		return "", "", err
+	}
+
+	var best *Route
+	onLink := false
+
+	// При нескольких маршрутах по умолчанию (Ethernet, Wi-Fi, VPN) Windows
+	// использует маршрут с наименьшей метрикой
+	for i, route := range routes {
+		if !route.HasGateway() {
+			onLink = true
+			continue
+		}
+		if best == nil || route.Metric < best.Metric {
+			best = &routes[i]
+		}
+	}
+
+	if best == nil {
+		if onLink {
+			return "", method, fmt.Errorf("default route has no gateway address (On-link)")
+		}
+		return "", method, fmt.Errorf("default gateway not found in routing table")
+	}
+
+	return best.Gateway, method, nil
+}
+
+func ActiveGateways() ([]string, error) {
+	gateways, _, err := activeGateways()
+	return gateways, err
+}
+
+// activeGateways возвращает шлюзы подключённых адаптеров и способ их получения
+func activeGateways() ([]string, string, error) {
+	adapters, apiErr := AdapterGateways()
+	if apiErr == nil {
+		var gateways []string
+		for _, adapter := range adapters {
+			gateways = append(gateways, adapter.Gateways...)
+		}
+		if len(gateways) == 0 {
+			return nil, methodAdapterAddress, fmt.Errorf("no active gateways found")
+		}
+		return gateways, methodAdapterAddress, nil
+	}
+
+	gateways, err := netshGateways()
+	if err != nil {
+		return nil, "", fmt.Errorf("%v; %v", apiErr, err)
+	}
+	return gateways, methodNetshShowConfig, nil
+}
+
+// netshGateways разбирает шлюзы из вывода netsh interface ip show config
+func netshGateways() ([]string, error) {
+	cmd := exec.Command("netsh", "interface", "ip", "show", "config")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("netsh failed: %v", err)
+	}
+
+	var gateways []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, pattern := range gatewayPatterns {
+			if matches := pattern.FindStringSubmatch(line); matches != nil && len(matches) > 1 {
+				gateway := matches[1]
+				if gateway != "0.0.0.0" {
+					gateways = append(gateways, gateway)
+				}
+			}
+		}
+	}
+
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no active gateways found")
+	}
+
+	return gateways, nil
+}
+
+var arpEntryPattern = regexp.MustCompile(`^\s*(\d+\.\d+\.\d+\.\d+)\s+([0-9a-fA-F]{2}(?:[-:][0-9a-fA-F]{2}){5})\s`)
+
+func lookupARP(ip string) (string, error) {
+	cmd := exec.Command("arp", "-a", ip)
+	output, err := cmd.Output()
+	if err != nil {
+		// arp возвращает ошибку, если записи нет
+		return "", nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if matches := arpEntryPattern.FindStringSubmatch(scanner.Text()); matches != nil && matches[1] == ip {
+			return NormalizeMAC(matches[2]), nil
+		}
+	}
+
+	return "", nil
+}
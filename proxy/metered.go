@@ -0,0 +1,28 @@
+package proxy
+
+import "fmt"
+
+// Флаги NLM_CONNECTION_COST
+const (
+	connectionCostUnrestricted = 0x1
+	connectionCostFixed        = 0x2
+	connectionCostVariable     = 0x4
+	connectionCostRoaming      = 0x40000
+)
+
+// IsMetered сообщает, тарифицируется ли текущее подключение: фиксированный
+// или повременный тариф либо роуминг
+func (c *Config) IsMetered() (bool, error) {
+	cost, err := ConnectionCost()
+	if err != nil {
+		return false, err
+	}
+	if cost&(connectionCostFixed|connectionCostVariable|connectionCostRoaming) != 0 {
+		c.logInfo(fmt.Sprintf("Connection is metered (cost flags 0x%x)", cost))
+		return true, nil
+	}
+	if cost&connectionCostUnrestricted == 0 {
+		c.logDebug(fmt.Sprintf("Connection cost unknown (0x%x), treated as not metered", cost))
+	}
+	return false, nil
+}
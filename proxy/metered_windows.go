@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	ole32                = windows.NewLazySystemDLL("ole32.dll")
+	procCoCreateInstance = ole32.NewProc("CoCreateInstance")
+
+	// CLSID_NetworkListManager и IID_INetworkCostManager из netlistmgr.h
+	clsidNetworkListManager = windows.GUID{Data1: 0xDCB00C01, Data2: 0x570F, Data3: 0x4A9B, Data4: [8]byte{0x8D, 0x69, 0x19, 0x9F, 0xDB, 0xA5, 0x72, 0x3B}}
+	iidNetworkCostManager   = windows.GUID{Data1: 0xDCB00008, Data2: 0x570F, Data3: 0x4A9B, Data4: [8]byte{0x8D, 0x69, 0x19, 0x9F, 0xDB, 0xA5, 0x72, 0x3B}}
+)
+
+const (
+	clsctxAll       = 0x17
+	sFalse          = 1
+	rpcEChangedMode = 0x80010106
+)
+
+// networkCostManager - интерфейс INetworkCostManager, таблица методов в порядке netlistmgr.h
+type networkCostManager struct {
+	vtbl *struct {
+		QueryInterface, AddRef, Release                     uintptr
+		GetCost, GetDataPlanStatus, SetDestinationAddresses uintptr
+	}
+}
+
+// ConnectionCost возвращает NLM_CONNECTION_COST для подключения машины
+// к интернету через INetworkCostManager::GetCost
+func ConnectionCost() (uint32, error) {
+	// COM инициализируется для потока, поэтому горутина к нему привязывается
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// S_FALSE (COM уже инициализирован в потоке) тоже требует CoUninitialize,
+	// RPC_E_CHANGED_MODE - нет: поток работает в другой модели, но COM доступен
+	err := windows.CoInitializeEx(0, windows.COINIT_MULTITHREADED)
+	errno, _ := err.(syscall.Errno)
+	switch {
+	case err == nil || errno == sFalse:
+		defer windows.CoUninitialize()
+	case uint32(errno) != rpcEChangedMode:
+		return 0, fmt.Errorf("CoInitializeEx failed: %v", err)
+	}
+
+	var manager *networkCostManager
+	hr, _, _ := procCoCreateInstance.Call(
+		uintptr(unsafe.Pointer(&clsidNetworkListManager)), 0, clsctxAll,
+		uintptr(unsafe.Pointer(&iidNetworkCostManager)),
+		uintptr(unsafe.Pointer(&manager)))
+	if hr != 0 {
+		return 0, fmt.Errorf("CoCreateInstance(NetworkListManager) failed: 0x%08x", uint32(hr))
+	}
+
+	defer syscall.SyscallN(manager.vtbl.Release, uintptr(unsafe.Pointer(manager)))
+
+	// pDestIPAddr = NULL: стоимость подключения машины в целом
+	var cost uint32
+	hr, _, _ = syscall.SyscallN(manager.vtbl.GetCost, uintptr(unsafe.Pointer(manager)), uintptr(unsafe.Pointer(&cost)), 0)
+	if hr != 0 {
+		return 0, fmt.Errorf("INetworkCostManager::GetCost failed: 0x%08x", uint32(hr))
+	}
+	return cost, nil
+}
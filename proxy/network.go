@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// DefaultVPNPattern совпадает с адаптерами распространённых VPN-клиентов
+const DefaultVPNPattern = `(?i)vpn|wireguard|tap-windows|wintun|fortinet|anyconnect|pangp|globalprotect`
+
+func (c *Config) CheckSSID() (bool, error) {
+	if c.SSID == "" {
+		return false, nil
+	}
+
+	ssids, err := CurrentSSIDs()
+	if err != nil {
+		return false, err
+	}
+	if len(ssids) == 0 {
+		c.logDebug("Not connected to any wireless network")
+		return false, nil
+	}
+
+	for _, ssid := range ssids {
+		if ssid == c.SSID {
+			c.logInfo(fmt.Sprintf("Wireless SSID match: %s", ssid))
+			return true, nil
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("Connected SSID %s does not match %s", strings.Join(ssids, ", "), c.SSID))
+	return false, nil
+}
+
+// AdapterGateway - шлюзы одного подключённого адаптера
+type AdapterGateway struct {
+	Index       uint32
+	Name        string
+	Description string
+	Metric      uint32
+	Addresses   []string
+	Gateways    []string
+}
+
+func (c *Config) CheckDNSSuffix() (bool, error) {
+	if c.DNSSuffix == "" {
+		return false, nil
+	}
+
+	suffixes, err := DNSSuffixes()
+	if err != nil {
+		return false, err
+	}
+
+	for _, suffix := range suffixes {
+		if strings.EqualFold(strings.TrimSuffix(suffix, "."), strings.TrimSuffix(c.DNSSuffix, ".")) {
+			c.logInfo(fmt.Sprintf("DNS suffix match: %s", suffix))
+			return true, nil
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("DNS suffixes [%s] do not match %s", strings.Join(suffixes, ", "), c.DNSSuffix))
+	return false, nil
+}
+
+// CheckDNSServer проверяет, назначен ли любому подключённому адаптеру один
+// из DNS-серверов DNSServer (список через ';')
+func (c *Config) CheckDNSServer() (bool, error) {
+	if c.DNSServer == "" {
+		return false, nil
+	}
+
+	servers, err := DNSServers()
+	if err != nil {
+		return false, err
+	}
+
+	var seen []string
+	for adapter, addresses := range servers {
+		for _, address := range addresses {
+			for _, expected := range strings.Split(c.DNSServer, ";") {
+				if address == strings.TrimSpace(expected) {
+					c.logInfo(fmt.Sprintf("DNS server match: %s on %s", address, adapter))
+					return true, nil
+				}
+			}
+			seen = append(seen, address)
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("DNS servers [%s] do not match %s", strings.Join(seen, ", "), c.DNSServer))
+	return false, nil
+}
+
+func (c *Config) ValidateDNSServer() error {
+	if c.DNSServer == "" {
+		if c.Mode == "dns" {
+			return fmt.Errorf("mode dns requires --dns-server")
+		}
+		return nil
+	}
+	for _, server := range strings.Split(c.DNSServer, ";") {
+		if net.ParseIP(strings.TrimSpace(server)) == nil {
+			return fmt.Errorf("invalid --dns-server %q, expected IP addresses separated by ';'", server)
+		}
+	}
+	return nil
+}
+
+func (c *Config) ProbeReachable() (bool, error) {
+	if c.Probe == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", c.Probe, c.ProbeTimeout)
+	if err != nil {
+		c.logDebug(fmt.Sprintf("Probe %s is not reachable: %v", c.Probe, err))
+		return false, nil
+	}
+	conn.Close()
+
+	c.logInfo(fmt.Sprintf("Probe %s is reachable", c.Probe))
+	return true, nil
+}
+
+func (c *Config) CompileVPNPattern() error {
+	pattern := c.VPNPattern
+	if pattern == "" {
+		pattern = DefaultVPNPattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid --vpn-pattern: %v", err)
+	}
+	c.vpnRegex = re
+	return nil
+}
+
+func (c *Config) CheckVPN() (bool, error) {
+	names, err := c.ActiveVPNAdapters()
+	if err != nil {
+		return false, err
+	}
+	if len(names) == 0 {
+		c.logDebug("No active VPN adapters")
+		return false, nil
+	}
+
+	c.logInfo(fmt.Sprintf("VPN adapter active: %s", strings.Join(names, ", ")))
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var ssidPattern = regexp.MustCompile(`^\s*SSID\s*: (.*)$`)
+
+// CurrentSSIDs возвращает SSID подключённых беспроводных сетей.
+// Отсутствие беспроводного адаптера или службы WLAN не считается ошибкой
+func CurrentSSIDs() ([]string, error) {
+	cmd := exec.Command("netsh", "wlan", "show", "interfaces")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil
+	}
+
+	var ssids []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if matches := ssidPattern.FindStringSubmatch(scanner.Text()); matches != nil {
+			ssid := strings.TrimSpace(matches[1])
+			if ssid != "" {
+				ssids = append(ssids, ssid)
+			}
+		}
+	}
+
+	return ssids, nil
+}
+
+// AdapterAddresses возвращает список сетевых адаптеров (IPv4) через
+// GetAdaptersAddresses, увеличивая буфер при ERROR_BUFFER_OVERFLOW
+func AdapterAddresses() ([]*windows.IpAdapterAddresses, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_INET, windows.GAA_FLAG_INCLUDE_GATEWAYS, 0, first, &size)
+		if err == nil {
+			var adapters []*windows.IpAdapterAddresses
+			for aa := first; aa != nil; aa = aa.Next {
+				adapters = append(adapters, aa)
+			}
+			return adapters, nil
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW {
+			return nil, fmt.Errorf("GetAdaptersAddresses failed: %v", err)
+		}
+	}
+}
+
+func AdapterGateways() ([]AdapterGateway, error) {
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []AdapterGateway
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+
+		adapter := AdapterGateway{
+			Index:       aa.IfIndex,
+			Name:        windows.UTF16PtrToString(aa.FriendlyName),
+			Description: windows.UTF16PtrToString(aa.Description),
+			Metric:      aa.Ipv4Metric,
+		}
+		for addr := aa.FirstUnicastAddress; addr != nil; addr = addr.Next {
+			if ip := addr.Address.IP(); ip != nil {
+				adapter.Addresses = append(adapter.Addresses, ip.String())
+			}
+		}
+		for gw := aa.FirstGatewayAddress; gw != nil; gw = gw.Next {
+			ip := gw.Address.IP()
+			if ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			adapter.Gateways = append(adapter.Gateways, ip.String())
+		}
+		result = append(result, adapter)
+	}
+
+	return result, nil
+}
+
+func DNSSuffixes() ([]string, error) {
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		if suffix := windows.UTF16PtrToString(aa.DnsSuffix); suffix != "" {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+
+	return suffixes, nil
+}
+
+// DNSServers возвращает DNS-серверы подключённых адаптеров по имени адаптера
+func DNSServers() (map[string][]string, error) {
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make(map[string][]string)
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		name := windows.UTF16PtrToString(aa.FriendlyName)
+		for dns := aa.FirstDnsServerAddress; dns != nil; dns = dns.Next {
+			if ip := dns.Address.IP(); ip != nil {
+				servers[name] = append(servers[name], ip.String())
+			}
+		}
+	}
+
+	return servers, nil
+}
+
+// ActiveVPNAdapters возвращает имена подключённых VPN-адаптеров: PPP и
+// туннельных по типу интерфейса, остальных - по VPNPattern
+func (c *Config) ActiveVPNAdapters() ([]string, error) {
+	if c.vpnRegex == nil {
+		if err := c.CompileVPNPattern(); err != nil {
+			return nil, err
+		}
+	}
+
+	adapters, err := AdapterAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, aa := range adapters {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		name := windows.UTF16PtrToString(aa.FriendlyName)
+		description := windows.UTF16PtrToString(aa.Description)
+		if aa.IfType == windows.IF_TYPE_PPP || aa.IfType == windows.IF_TYPE_TUNNEL ||
+			c.vpnRegex.MatchString(name) || c.vpnRegex.MatchString(description) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const protocolICMP = 1
+
+// Ping отправляет ICMP echo и ждёт ответа не дольше timeout. Сырой сокет
+// ICMP в Windows доступен только администратору (служба работает от LocalSystem)
+func Ping(address string, timeout time.Duration) error {
+	dst, err := net.ResolveIPAddr("ip4", address)
+	if err != nil {
+		return fmt.Errorf("invalid ping address %s: %v", address, err)
+	}
+
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return fmt.Errorf("cannot open ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	request := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("espd")},
+	}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		return fmt.Errorf("cannot send ping to %s: %v", address, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	// На сырой сокет приходят все ICMP-пакеты, ждём ответ именно на наш запрос
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("no ping reply from %s: %v", address, err)
+		}
+		reply, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && peer.String() == dst.String() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	policySettingsKey  = `Software\Policies\Microsoft\Windows\CurrentVersion\Internet Settings`
+	machineSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+)
+
+// PolicyLocation - ключ, из которого Windows берёт прокси вместо HKCU
+type PolicyLocation struct {
+	Root registry.Key
+	Path string
+	Name string
+}
+
+// PolicyLocations находит настройки прокси, заданные групповой политикой:
+// значения прокси в разделах Policies HKLM и HKCU, а также
+// ProxySettingsPerUser=0, при котором действуют машинные настройки из HKLM
+func PolicyLocations() []PolicyLocation {
+	var locations []PolicyLocation
+	for _, location := range []PolicyLocation{
+		{registry.LOCAL_MACHINE, policySettingsKey, `HKLM\` + policySettingsKey},
+		{registry.CURRENT_USER, policySettingsKey, `HKCU\` + policySettingsKey},
+	} {
+		if hasProxyValues(location.Root, location.Path) {
+			locations = append(locations, location)
+		}
+	}
+
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, policySettingsKey, registry.QUERY_VALUE); err == nil {
+		perUser, _, err := k.GetIntegerValue("ProxySettingsPerUser")
+		k.Close()
+		if err == nil && perUser == 0 {
+			locations = append(locations, PolicyLocation{registry.LOCAL_MACHINE, machineSettingsKey, `HKLM\` + machineSettingsKey})
+		}
+	}
+
+	return locations
+}
+
+func hasProxyValues(root registry.Key, path string) bool {
+	k, err := registry.OpenKey(root, path, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+
+	for _, name := range []string{"ProxyEnable", "ProxyServer", "ProxyOverride"} {
+		if _, _, err := k.GetValue(name, nil); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolicy записывает настройки в ключи политик при GPO или
+// предупреждает, что запись в HKCU будет перекрыта политикой
+func (c *Config) applyPolicy(enable bool, server, override string) error {
+	locations := PolicyLocations()
+	if !c.GPO {
+		if len(locations) > 0 && !c.policyWarned {
+			c.policyWarned = true
+			for _, location := range locations {
+				c.logWarn(fmt.Sprintf("Proxy is enforced by policy in %s, changes to HKCU will be ignored (use --gpo)", location.Name))
+			}
+		}
+		return nil
+	}
+
+	if len(locations) == 0 {
+		locations = []PolicyLocation{{registry.CURRENT_USER, policySettingsKey, `HKCU\` + policySettingsKey}}
+	}
+	for _, location := range locations {
+		if err := writeSettings(location.Root, location.Path, enable, server, override); err != nil {
+			return fmt.Errorf("%s: %v", location.Name, err)
+		}
+		c.logDebug(fmt.Sprintf("Proxy settings written to policy key %s", location.Name))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GatewayProvider возвращает шлюзы текущей машины
+type GatewayProvider interface {
+	DefaultGateway() (string, error)
+	ActiveGateways() ([]string, error)
+	AdapterGateways() ([]AdapterGateway, error)
+}
+
+// UserProvider возвращает учётную запись, от имени которой идёт проверка
+type UserProvider interface {
+	CurrentUsername() (string, error)
+	UserPrincipalName() (string, error)
+	CurrentUserGroups() ([]string, error)
+	CurrentUserSID() (string, error)
+}
+
+// ProxyStore читает и записывает настройки прокси
+type ProxyStore interface {
+	CurrentSettings() (bool, string, error)
+	SetProxy(enable bool, server, override string) error
+}
+
+// noteGatewayMethod пишет в лог способ определения шлюза при первом
+// успехе и при каждой его смене, например при переходе на route/netsh
+func (c *Config) noteGatewayMethod(what, method string) {
+	if method == "" {
+		return
+	}
+	if c.gatewayMethods == nil {
+		c.gatewayMethods = make(map[string]string)
+	}
+	if c.gatewayMethods[what] != method {
+		c.gatewayMethods[what] = method
+		c.logInfo(fmt.Sprintf("%s detected via %s", what, method))
+	}
+}
+
+// Незаданные поля Gateways, Users и Store заменяются системными реализациями
+
+func (c *Config) gateways() GatewayProvider {
+	if c.Gateways != nil {
+		return c.Gateways
+	}
+	return systemGateways{c}
+}
+
+func (c *Config) users() UserProvider {
+	if c.Users != nil {
+		return c.Users
+	}
+	return systemUsers{}
+}
+
+// GatewaySource и UserSource возвращают источники, по которым идёт проверка,
+// с учётом подмены (например, --simulate-gateway и --simulate-user)
+
+func (c *Config) GatewaySource() GatewayProvider {
+	return c.gateways()
+}
+
+func (c *Config) UserSource() UserProvider {
+	return c.users()
+}
+
+func (c *Config) store() ProxyStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return &registryStore{c}
+}
+
+// SimulatedGateways выдаёт заданный адрес за шлюз по умолчанию единственного
+// адаптера - для проверки логики решения вне целевой сети
+type SimulatedGateways struct{ Gateway string }
+
+func (g SimulatedGateways) DefaultGateway() (string, error)   { return g.Gateway, nil }
+func (g SimulatedGateways) ActiveGateways() ([]string, error) { return []string{g.Gateway}, nil }
+func (g SimulatedGateways) AdapterGateways() ([]AdapterGateway, error) {
+	return []AdapterGateway{{Name: "Simulated", Description: "Simulated adapter", Gateways: []string{g.Gateway}}}, nil
+}
+
+// SimulatedUsers выдаёт заданное имя за текущего пользователя. Имя вида
+// user@domain считается и UPN, а S-1-... - SID; группы не моделируются
+type SimulatedUsers struct{ User string }
+
+func (u SimulatedUsers) CurrentUsername() (string, error) { return u.User, nil }
+func (u SimulatedUsers) UserPrincipalName() (string, error) {
+	if strings.Contains(u.User, "@") {
+		return u.User, nil
+	}
+	return "", nil
+}
+func (u SimulatedUsers) CurrentUserGroups() ([]string, error) { return nil, nil }
+func (u SimulatedUsers) CurrentUserSID() (string, error) {
+	if strings.HasPrefix(strings.ToUpper(u.User), "S-1-") {
+		return u.User, nil
+	}
+	return "", nil
+}
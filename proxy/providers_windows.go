@@ -0,0 +1,28 @@
+package proxy
+
+// systemGateways и systemUsers - реализации по умолчанию поверх iphlpapi
+// (с route/netsh как запасным путём) и токена процесса
+type systemGateways struct{ c *Config }
+
+func (g systemGateways) DefaultGateway() (string, error) {
+	gateway, method, err := defaultGateway()
+	g.c.noteGatewayMethod("Default gateway", method)
+	return gateway, err
+}
+
+func (g systemGateways) ActiveGateways() ([]string, error) {
+	gateways, method, err := activeGateways()
+	g.c.noteGatewayMethod("Active gateways", method)
+	return gateways, err
+}
+
+func (systemGateways) AdapterGateways() ([]AdapterGateway, error) {
+	return AdapterGateways()
+}
+
+type systemUsers struct{}
+
+func (systemUsers) CurrentUsername() (string, error)     { return CurrentUsername() }
+func (systemUsers) UserPrincipalName() (string, error)   { return UserPrincipalName() }
+func (systemUsers) CurrentUserGroups() ([]string, error) { return CurrentUserGroups() }
+func (systemUsers) CurrentUserSID() (string, error)      { return CurrentUserSID() }
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// schedule - окно времени, в которое прокси может быть включён.
+// Время в минутах от полуночи, окно через полночь (22:00-06:00) допускается
+type schedule struct {
+	start, end int
+	days       map[time.Weekday]bool
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(value string) (time.Weekday, error) {
+	day, ok := weekdayNames[strings.ToLower(strings.TrimSpace(value))]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q, expected Mon..Sun", value)
+	}
+	return day, nil
+}
+
+// ParseSchedule разбирает Hours и Days. Без них ограничений нет
+func (c *Config) ParseSchedule() error {
+	if c.Hours == "" && c.Days == "" {
+		c.activeWindow = nil
+		return nil
+	}
+
+	window := &schedule{start: 0, end: 24 * 60}
+
+	if c.Hours != "" {
+		parts := strings.SplitN(c.Hours, "-", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid --hours %q, expected HH:MM-HH:MM", c.Hours)
+		}
+		var err error
+		if window.start, err = parseClock(parts[0]); err != nil {
+			return err
+		}
+		if window.end, err = parseClock(parts[1]); err != nil {
+			return err
+		}
+	}
+
+	if c.Days != "" {
+		window.days = make(map[time.Weekday]bool)
+		for _, item := range strings.Split(c.Days, ",") {
+			bounds := strings.SplitN(item, "-", 2)
+			first, err := parseWeekday(bounds[0])
+			if err != nil {
+				return err
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = parseWeekday(bounds[1]); err != nil {
+					return err
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				window.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+
+	c.activeWindow = window
+	return nil
+}
+
+func (w *schedule) contains(now time.Time) bool {
+	if w.days != nil && !w.days[now.Weekday()] {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// RunCheckCommand выполняет CheckCommand через cmd /C: код возврата 0 -
+// включить прокси, любой другой - выключить. Вывод команды пишется в лог.
+// Ошибкой считаются только запуск и превышение CheckTimeout
+func (c *Config) RunCheckCommand() (bool, error) {
+	if c.CheckCommand == "" {
+		return false, fmt.Errorf("mode script requires --check-command")
+	}
+
+	ctx := context.Background()
+	if c.CheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CheckTimeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := checkCommand(ctx, c.CheckCommand)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// По таймауту завершается только cmd.exe. Запущенные им процессы держат
+	// stdout и stderr открытыми, и без WaitDelay Run ждал бы их сколько угодно
+	cmd.WaitDelay = checkWaitDelay
+	err := cmd.Run()
+
+	if output := strings.TrimSpace(stdout.String()); output != "" {
+		c.logInfo(fmt.Sprintf("Check command output: %s", output))
+	}
+	if output := strings.TrimSpace(stderr.String()); output != "" {
+		c.logWarn(fmt.Sprintf("Check command error output: %s", output))
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("check command timed out after %s", c.CheckTimeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		c.logDebug(fmt.Sprintf("Check command exited with code %d", exitErr.ExitCode()))
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot run check command: %v", err)
+	}
+
+	c.logDebug("Check command exited with code 0")
+	return true, nil
+}
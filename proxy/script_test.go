@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRunCheckCommandTimeoutWithChild(t *testing.T) {
+	// Дочерний процесс переживает оболочку и держит её stdout открытым
+	command := "sleep 30; :"
+	if runtime.GOOS == "windows" {
+		command = "ping -n 30 127.0.0.1"
+	}
+	c := &Config{CheckCommand: command, CheckTimeout: 200 * time.Millisecond}
+
+	start := time.Now()
+	ok, err := c.RunCheckCommand()
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("RunCheckCommand() returned after %s, want about CheckTimeout+WaitDelay", elapsed)
+	}
+	if ok || err == nil {
+		t.Errorf("RunCheckCommand() = %v, %v, want a timeout error", ok, err)
+	}
+}
@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// checkCommand запускает строку через cmd /C. Командная строка передаётся
+// cmd как есть: стандартное экранирование аргументов ломает кавычки в путях с пробелами
+func checkCommand(ctx context.Context, line string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "cmd.exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: "cmd.exe /C " + line}
+	return cmd
+}
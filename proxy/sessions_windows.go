@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// SessionUser - пользователь сеанса Windows и его основной токен
+type SessionUser struct {
+	SessionID uint32
+	SID       string
+	Token     windows.Token
+}
+
+// userSessions возвращает пользователей активных и отключённых сеансов: у
+// отключённого пользователя куст загружен и приложения продолжают работать.
+// WTSQueryUserToken доступен только процессу, работающему от LocalSystem.
+// Токены закрывает closeSessions
+func userSessions() ([]SessionUser, error) {
+	var sessions *windows.WTS_SESSION_INFO
+	var count uint32
+	if err := windows.WTSEnumerateSessions(0, 0, 1, &sessions, &count); err != nil {
+		return nil, fmt.Errorf("WTSEnumerateSessions failed: %v", err)
+	}
+	defer windows.WTSFreeMemory(uintptr(unsafe.Pointer(sessions)))
+
+	var users []SessionUser
+	for _, session := range unsafe.Slice(sessions, count) {
+		if session.State != windows.WTSActive && session.State != windows.WTSDisconnected {
+			continue
+		}
+
+		var token windows.Token
+		if err := windows.WTSQueryUserToken(session.SessionID, &token); err != nil {
+			if err == windows.ERROR_PRIVILEGE_NOT_HELD {
+				closeSessions(users)
+				return nil, fmt.Errorf("WTSQueryUserToken failed, --all-sessions requires LocalSystem: %w", err)
+			}
+			// В сеансе нет вошедшего пользователя (ERROR_NO_TOKEN)
+			continue
+		}
+		tokenUser, err := token.GetTokenUser()
+		if err != nil {
+			token.Close()
+			continue
+		}
+		users = append(users, SessionUser{session.SessionID, tokenUser.User.Sid.String(), token})
+	}
+
+	return users, nil
+}
+
+func closeSessions(users []SessionUser) {
+	for _, user := range users {
+		if user.Token != 0 {
+			user.Token.Close()
+		}
+	}
+}
+
+// notLocalSystem сообщает, что userSessions отказал из-за прав: процесс
+// запущен администратором (--disable-now, --uninstall), а не службой
+func notLocalSystem(err error) bool {
+	return errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD)
+}
+
+// loadedUserSIDs возвращает SID пользователей с загруженным кустом
+// HKEY_USERS\<SID>. Токены сеансов есть только у LocalSystem, а кусты
+// вошедших пользователей видны и администратору
+func loadedUserSIDs() ([]string, error) {
+	names, err := registry.USERS.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("cannot enumerate HKEY_USERS: %v", err)
+	}
+
+	var sids []string
+	for _, name := range names {
+		// S-1-5-21 - локальные и доменные учётные записи, S-1-12-1 - Azure AD;
+		// <SID>_Classes - второй куст того же пользователя
+		if (strings.HasPrefix(name, "S-1-5-21-") || strings.HasPrefix(name, "S-1-12-1-")) && !strings.HasSuffix(name, "_Classes") {
+			sids = append(sids, name)
+		}
+	}
+	return sids, nil
+}
+
+// SessionUserSIDs возвращает SID пользователей активных и отключённых сеансов,
+// а вне LocalSystem - пользователей с загруженным кустом
+func SessionUserSIDs() ([]string, error) {
+	users, err := userSessions()
+	if notLocalSystem(err) {
+		return loadedUserSIDs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closeSessions(users)
+
+	var sids []string
+	seen := make(map[string]bool)
+	for _, user := range users {
+		// Один пользователь может быть в нескольких сеансах
+		if !seen[user.SID] {
+			seen[user.SID] = true
+			sids = append(sids, user.SID)
+		}
+	}
+	return sids, nil
+}
+
+// sessionUsers - UserProvider пользователя другого сеанса: имя, группы и SID
+// берутся из его токена, а не из токена службы
+type sessionUsers struct{ token windows.Token }
+
+func (u sessionUsers) CurrentUsername() (string, error) {
+	tokenUser, err := u.token.GetTokenUser()
+	if err != nil {
+		return "", fmt.Errorf("GetTokenInformation failed: %v", err)
+	}
+	account, domain, _, err := tokenUser.User.Sid.LookupAccount("")
+	if err != nil {
+		return "", fmt.Errorf("LookupAccountSid failed: %v", err)
+	}
+	return domain + `\` + account, nil
+}
+
+func (u sessionUsers) UserPrincipalName() (string, error) {
+	lookup := func() (string, error) {
+		return impersonate(u.token, func() (string, error) {
+			return UserNameEx(windows.NameUserPrincipal)
+		})
+	}
+	return principalName(lookup, u.CurrentUsername, u.CurrentUserSID)
+}
+
+func (u sessionUsers) CurrentUserGroups() ([]string, error) {
+	return tokenGroups(u.token)
+}
+
+func (u sessionUsers) CurrentUserSID() (string, error) {
+	tokenUser, err := u.token.GetTokenUser()
+	if err != nil {
+		return "", fmt.Errorf("GetTokenInformation failed: %v", err)
+	}
+	return tokenUser.User.Sid.String(), nil
+}
+
+// impersonate выполняет fn от имени пользователя токена: GetUserNameEx
+// возвращает имя только той учётной записи, от которой работает поток
+func impersonate(token windows.Token, fn func() (string, error)) (string, error) {
+	var impersonation windows.Token
+	err := windows.DuplicateTokenEx(token, windows.TOKEN_QUERY|windows.TOKEN_IMPERSONATE, nil,
+		windows.SecurityImpersonation, windows.TokenImpersonation, &impersonation)
+	if err != nil {
+		return "", fmt.Errorf("DuplicateTokenEx failed: %v", err)
+	}
+	defer impersonation.Close()
+
+	// Токен назначается потоку, поэтому горутина к нему привязывается
+	runtime.LockOSThread()
+	if err := windows.SetThreadToken(nil, impersonation); err != nil {
+		runtime.UnlockOSThread()
+		return "", fmt.Errorf("SetThreadToken failed: %v", err)
+	}
+	defer func() {
+		// Поток, который не вернулся к учётной записи службы, не отдаётся
+		// другим горутинам: Go завершит его вместе с этой
+		if windows.RevertToSelf() == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn()
+}
+
+// evaluateSessions проверяет условия для пользователя каждого сеанса.
+// Итоговый Enable - есть ли пользователь, которому прокси нужен; запись
+// по пользователям выполняет SetProxy по sessionDecisions
+func (c *Config) evaluateSessions() (Decision, error) {
+	var decision Decision
+	sessions, err := userSessions()
+	if err != nil {
+		return decision, err
+	}
+	defer closeSessions(sessions)
+
+	decisions := make(map[string]bool)
+	var reasons []string
+	for _, session := range sessions {
+		if _, seen := decisions[session.SID]; seen {
+			continue
+		}
+
+		users := sessionUsers{session.Token}
+		name, err := users.CurrentUsername()
+		if err != nil {
+			name = session.SID
+		}
+
+		sc := *c
+		sc.AllSessions = false
+		sc.Users = users
+		d, err := sc.evaluate()
+		if err != nil {
+			return decision, fmt.Errorf("session %d (%s): %v", session.SessionID, name, err)
+		}
+
+		decisions[session.SID] = d.Enable
+		decision.Sessions = append(decision.Sessions, SessionDecision{session.SID, name, d.Enable, d.Reason})
+		decision.Enable = decision.Enable || d.Enable
+		decision.GatewayMatched = decision.GatewayMatched || d.GatewayMatched
+		decision.UserMatched = decision.UserMatched || d.UserMatched
+		if decision.Site == "" {
+			decision.Site = d.Site
+		}
+		reasons = append(reasons, name+": "+d.Reason)
+	}
+
+	c.sessionDecisions = decisions
+	if len(reasons) == 0 {
+		decision.Reason = "no user sessions"
+	} else {
+		decision.Reason = strings.Join(reasons, "; ")
+	}
+	return decision, nil
+}
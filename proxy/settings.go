@@ -0,0 +1,22 @@
+package proxy
+
+// CurrentSettings возвращает состояние прокси из Store
+func (c *Config) CurrentSettings() (bool, string, error) {
+	return c.store().CurrentSettings()
+}
+
+// SetProxy при включении сначала выбирает доступный прокси из Server
+func (c *Config) SetProxy(enable bool) error {
+	if enable {
+		c.SelectServer()
+	}
+	return c.store().SetProxy(enable, c.ProxyServer(), c.ProxyOverride())
+}
+
+// UserSettings - состояние прокси в кусте одного пользователя
+type UserSettings struct {
+	Location string
+	SID      string
+	Enabled  bool
+	Server   string
+}
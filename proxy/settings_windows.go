@@ -0,0 +1,579 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+var (
+	wininet               = windows.NewLazySystemDLL("wininet.dll")
+	procInternetSetOption = wininet.NewProc("InternetSetOptionW")
+)
+
+// CurrentSettings читает ProxyEnable и ProxyServer текущего пользователя
+func CurrentSettings() (bool, string, error) {
+	return readSettings(registry.CURRENT_USER, internetSettingsKey)
+}
+
+// SettingsValues возвращает значения прокси WinINET текущего пользователя
+// как есть, для диагностики. Отсутствующие значения пропускаются
+func SettingsValues() (map[string]string, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.READ)
+	if err == registry.ErrNotExist {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	values := make(map[string]string)
+	if enabled, _, err := k.GetIntegerValue("ProxyEnable"); err == nil {
+		values["ProxyEnable"] = fmt.Sprint(enabled)
+	}
+	for _, name := range []string{"ProxyServer", "ProxyOverride", "AutoConfigURL"} {
+		if value, _, err := k.GetStringValue(name); err == nil {
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+// settingsKey - операции с ключом Internet Settings, которые нужны чтению
+// и записи настроек. Реализуется registry.Key
+type settingsKey interface {
+	GetIntegerValue(name string) (uint64, uint32, error)
+	GetStringValue(name string) (string, uint32, error)
+	SetDWordValue(name string, value uint32) error
+	SetStringValue(name, value string) error
+	DeleteValue(name string) error
+}
+
+// На чистом профиле ключа или значения ProxyEnable может не быть -
+// это означает, что прокси выключен, а не ошибку
+func readSettings(root registry.Key, path string) (bool, string, error) {
+	k, err := registry.OpenKey(root, path, registry.READ)
+	if err == registry.ErrNotExist {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	defer k.Close()
+
+	return readKeySettings(k)
+}
+
+func readKeySettings(k settingsKey) (bool, string, error) {
+	enabled, _, err := k.GetIntegerValue("ProxyEnable")
+	if err == registry.ErrNotExist {
+		enabled = 0
+	} else if err != nil {
+		return false, "", err
+	}
+
+	server, _, err := k.GetStringValue("ProxyServer")
+	if err != nil {
+		server = ""
+	}
+
+	return enabled == 1, server, nil
+}
+
+// settingsSnapshot - значения прокси до записи, чтобы при ошибке на
+// середине не оставить в реестре ProxyServer от одной настройки и
+// ProxyOverride от другой
+type settingsSnapshot struct {
+	enable      uint64
+	server      string
+	override    string
+	hasEnable   bool
+	hasServer   bool
+	hasOverride bool
+}
+
+func takeSnapshot(k settingsKey) settingsSnapshot {
+	var snap settingsSnapshot
+	var err error
+	snap.enable, _, err = k.GetIntegerValue("ProxyEnable")
+	snap.hasEnable = err == nil
+	snap.server, _, err = k.GetStringValue("ProxyServer")
+	snap.hasServer = err == nil
+	snap.override, _, err = k.GetStringValue("ProxyOverride")
+	snap.hasOverride = err == nil
+	return snap
+}
+
+// restore возвращает значения снимка; отсутствовавшие значения удаляются
+func (snap settingsSnapshot) restore(k settingsKey) error {
+	var errs []string
+	setString := func(name, value string, present bool) {
+		var err error
+		if present {
+			err = k.SetStringValue(name, value)
+		} else if err = k.DeleteValue(name); err == registry.ErrNotExist {
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if snap.hasEnable {
+		if err := k.SetDWordValue("ProxyEnable", uint32(snap.enable)); err != nil {
+			errs = append(errs, fmt.Sprintf("ProxyEnable: %v", err))
+		}
+	} else if err := k.DeleteValue("ProxyEnable"); err != nil && err != registry.ErrNotExist {
+		errs = append(errs, fmt.Sprintf("ProxyEnable: %v", err))
+	}
+	setString("ProxyServer", snap.server, snap.hasServer)
+	setString("ProxyOverride", snap.override, snap.hasOverride)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeAtomically выполняет write и при ошибке откатывает ключ к снимку
+func writeAtomically(k settingsKey, write func() error) error {
+	snap := takeSnapshot(k)
+	err := write()
+	if err == nil {
+		return nil
+	}
+	if rollbackErr := snap.restore(k); rollbackErr != nil {
+		return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+	}
+	return err
+}
+
+func writeSettings(root registry.Key, path string, enable bool, server, override string) error {
+	// CreateKey открывает существующий ключ или создаёт его на новом профиле
+	k, _, err := registry.CreateKey(root, path, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	return writeKeySettings(k, enable, server, override)
+}
+
+func writeKeySettings(k settingsKey, enable bool, server, override string) error {
+	var enableValue uint32 = 0
+	if enable {
+		enableValue = 1
+	}
+
+	return writeAtomically(k, func() error {
+		if err := k.SetDWordValue("ProxyEnable", enableValue); err != nil {
+			return err
+		}
+		if !enable {
+			return nil
+		}
+		if err := k.SetStringValue("ProxyServer", server); err != nil {
+			return err
+		}
+		return k.SetStringValue("ProxyOverride", override)
+	})
+}
+
+// writeServerOnly меняет адрес прокси, не трогая ProxyEnable: при включении
+// записываются ProxyServer и ProxyOverride, при выключении удаляется только
+// ProxyServer. Так пользователей переводят на новый прокси без момента,
+// когда ProxyEnable=0 и соединения идут напрямую
+func writeServerOnly(root registry.Key, path string, enable bool, server, override string) error {
+	k, _, err := registry.CreateKey(root, path, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	return writeAtomically(k, func() error {
+		if !enable {
+			if err := k.DeleteValue("ProxyServer"); err != nil && err != registry.ErrNotExist {
+				return err
+			}
+			return nil
+		}
+		if err := k.SetStringValue("ProxyServer", server); err != nil {
+			return err
+		}
+		return k.SetStringValue("ProxyOverride", override)
+	})
+}
+
+// registryStore пишет настройки в HKCU (или в HKEY_USERS\<SID> пользователей
+// сеансов при AllSessions) и уведомляет WinINET и WinHTTP
+type registryStore struct {
+	c *Config
+}
+
+// CurrentSettings при AllSessions возвращает настройки пользователя, которому
+// служба включила прокси, а если такого нет - первого сеанса
+func (s *registryStore) CurrentSettings() (bool, string, error) {
+	if !s.c.AllSessions {
+		return CurrentSettings()
+	}
+
+	sids, err := SessionUserSIDs()
+	if err != nil {
+		return false, "", err
+	}
+	if len(sids) == 0 {
+		return false, "", nil
+	}
+	for _, sid := range sids {
+		enabled, server, err := readSettings(registry.USERS, sid+`\`+internetSettingsKey)
+		if err == nil && enabled && s.c.OwnsServer(server) {
+			return enabled, server, nil
+		}
+	}
+	return readSettings(registry.USERS, sids[0]+`\`+internetSettingsKey)
+}
+
+// AllCurrentSettings читает настройки HKCU или, при AllSessions, всех
+// пользователей сеансов. Только чтение, для режима аудита
+func (c *Config) AllCurrentSettings() ([]UserSettings, error) {
+	if !c.AllSessions {
+		enabled, server, err := CurrentSettings()
+		if err != nil {
+			return nil, err
+		}
+		return []UserSettings{{Location: "HKCU", Enabled: enabled, Server: server}}, nil
+	}
+
+	sids, err := SessionUserSIDs()
+	if err != nil {
+		return nil, err
+	}
+	var result []UserSettings
+	for _, sid := range sids {
+		enabled, server, err := readSettings(registry.USERS, sid+`\`+internetSettingsKey)
+		if err != nil {
+			return nil, fmt.Errorf("HKEY_USERS\\%s: %v", sid, err)
+		}
+		result = append(result, UserSettings{Location: "HKEY_USERS\\" + sid, SID: sid, Enabled: enabled, Server: server})
+	}
+	return result, nil
+}
+
+// SetProxy при AllSessions записывает каждому пользователю его собственное
+// решение из Evaluate: прокси включается только тем, кто прошёл проверку
+func (s *registryStore) SetProxy(enable bool, server, override string) error {
+	var sessions []SessionUser
+	if s.c.AllSessions {
+		all, err := userSessions()
+		if notLocalSystem(err) && !enable {
+			// Выключение из консоли администратора: сеансы без токенов,
+			// уведомить их нельзя, но записать куст можно
+			var sids []string
+			if sids, err = loadedUserSIDs(); err == nil {
+				for _, sid := range sids {
+					all = append(all, SessionUser{SID: sid})
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		defer closeSessions(all)
+		if len(all) == 0 {
+			s.c.logDebug("No user sessions, proxy settings not written")
+		}
+
+		written := make(map[string]bool)
+		for _, session := range all {
+			userEnable, ok := s.c.sessionEnabled(session.SID, enable)
+			if !ok {
+				s.c.logDebug(fmt.Sprintf("Session %d started after the check, settings written on the next one", session.SessionID))
+				continue
+			}
+			sessions = append(sessions, session)
+			// Один пользователь может быть в нескольких сеансах
+			if written[session.SID] {
+				continue
+			}
+			written[session.SID] = true
+
+			path := session.SID + `\` + internetSettingsKey
+			if err := s.applyTo(registry.USERS, session.SID+`\`, userEnable, server, override); err != nil {
+				return fmt.Errorf("HKEY_USERS\\%s: %v", path, err)
+			}
+			s.c.logDebug(fmt.Sprintf("Proxy settings (enable=%v) written to HKEY_USERS\\%s", userEnable, path))
+		}
+	} else if err := s.applyTo(registry.CURRENT_USER, "", enable, server, override); err != nil {
+		return err
+	}
+
+	if err := s.c.applyPolicy(enable, server, override); err != nil {
+		return err
+	}
+
+	if s.c.WinHTTP {
+		if err := s.c.setWinHTTPProxy(enable); err != nil {
+			return err
+		}
+	}
+
+	if s.c.DotNet {
+		if err := s.c.setDotNetProxy(enable); err != nil {
+			return err
+		}
+	}
+
+	if s.c.AllSessions {
+		s.c.refreshSessions(sessions)
+	} else {
+		s.c.Refresh()
+	}
+	return nil
+}
+
+// applyTo записывает настройки в куст пользователя. Перед каждой записью
+// сохраняется исходная настройка пользователя, а при выключении она
+// возвращается вместо простого ProxyEnable=0 (если не задан NoRestore)
+func (s *registryStore) applyTo(root registry.Key, prefix string, enable bool, server, override string) error {
+	settingsPath := prefix + internetSettingsKey
+	backupPath := prefix + originalSettingsKey
+
+	if s.c.ServerOnly {
+		return writeServerOnly(root, settingsPath, enable, server, override)
+	}
+
+	if !s.c.NoRestore {
+		// Копия нужна и при первом выключении: служба может начать работу,
+		// когда прокси уже нужно выключить
+		if err := captureOriginal(root, settingsPath, backupPath, s.c.OwnsServer); err != nil {
+			s.c.logWarn(fmt.Sprintf("Cannot save original proxy settings: %v", err))
+		}
+		if !enable {
+			return s.restoreUser(root, settingsPath, backupPath)
+		}
+	}
+
+	return writeSettings(root, settingsPath, enable, server, override)
+}
+
+// restoreUser при выключении возвращает сохранённую настройку, только если
+// в кусте записан наш прокси. Собственная настройка пользователя не
+// трогается и не перезаписывается копией на каждой проверке
+func (s *registryStore) restoreUser(root registry.Key, settingsPath, backupPath string) error {
+	_, current, err := readSettings(root, settingsPath)
+	if err != nil {
+		return err
+	}
+	if !s.c.OwnsServer(current) {
+		s.c.logDebug("Proxy settings belong to the user, left as is")
+		return nil
+	}
+
+	restored, err := restoreOriginal(root, settingsPath, backupPath)
+	if err != nil {
+		return err
+	}
+	if restored {
+		s.c.logDebug("Original proxy settings restored")
+		return nil
+	}
+	// Копию сохранить не удалось: выключается только наш прокси
+	return writeSettings(root, settingsPath, false, "", "")
+}
+
+// captureOriginal сохраняет ProxyEnable/ProxyServer/ProxyOverride в originalSettingsKey.
+// Пока в кусте наш прокси, копия не меняется, а если её ещё нет, исходной
+// считается выключенный прокси. Иначе копия следует за настройкой пользователя:
+// он мог изменить её, пока прокси был выключен
+func captureOriginal(root registry.Key, settingsPath, backupPath string, owned func(string) bool) error {
+	var current settingsSnapshot
+	if k, err := registry.OpenKey(root, settingsPath, registry.READ); err == nil {
+		current = takeSnapshot(k)
+		k.Close()
+	} else if err != registry.ErrNotExist {
+		return err
+	}
+
+	saved, exists, err := readOriginal(root, backupPath)
+	if err != nil {
+		return err
+	}
+	if owned(current.server) {
+		if exists {
+			return nil
+		}
+		current = settingsSnapshot{}
+	}
+	if exists && saved.enable == current.enable && saved.server == current.server && saved.override == current.override {
+		return nil
+	}
+
+	backup, _, err := registry.CreateKey(root, backupPath, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	if err := backup.SetDWordValue("ProxyEnable", uint32(current.enable)); err != nil {
+		return err
+	}
+	if err := backup.SetStringValue("ProxyServer", current.server); err != nil {
+		return err
+	}
+	return backup.SetStringValue("ProxyOverride", current.override)
+}
+
+// readOriginal читает копию из originalSettingsKey. Пустые ProxyServer и
+// ProxyOverride в копии означают, что значений не было
+func readOriginal(root registry.Key, backupPath string) (settingsSnapshot, bool, error) {
+	backup, err := registry.OpenKey(root, backupPath, registry.READ)
+	if err == registry.ErrNotExist {
+		return settingsSnapshot{}, false, nil
+	}
+	if err != nil {
+		return settingsSnapshot{}, false, err
+	}
+	defer backup.Close()
+
+	enabled, _, err := backup.GetIntegerValue("ProxyEnable")
+	if err != nil {
+		enabled = 0
+	}
+	server, _, _ := backup.GetStringValue("ProxyServer")
+	override, _, _ := backup.GetStringValue("ProxyOverride")
+	return settingsSnapshot{
+		enable:      enabled,
+		server:      server,
+		override:    override,
+		hasEnable:   true,
+		hasServer:   server != "",
+		hasOverride: override != "",
+	}, true, nil
+}
+
+// restoreOriginal возвращает сохранённую настройку. Копия не удаляется:
+// пока служба работает, она следит за настройкой пользователя
+func restoreOriginal(root registry.Key, settingsPath, backupPath string) (bool, error) {
+	original, exists, err := readOriginal(root, backupPath)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	k, _, err := registry.CreateKey(root, settingsPath, registry.ALL_ACCESS)
+	if err != nil {
+		return false, err
+	}
+	defer k.Close()
+
+	if err := writeAtomically(k, func() error { return original.restore(k) }); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RemoveOriginalSettings удаляет копию исходной настройки (originalSettingsKey)
+// из HKCU или, при AllSessions, из кустов пользователей сеансов
+func (c *Config) RemoveOriginalSettings() error {
+	if !c.AllSessions {
+		return removeOriginal(registry.CURRENT_USER, "")
+	}
+
+	sids, err := SessionUserSIDs()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, sid := range sids {
+		if err := removeOriginal(registry.USERS, sid+`\`); err != nil {
+			errs = append(errs, fmt.Sprintf("HKEY_USERS\\%s: %v", sid, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func removeOriginal(root registry.Key, prefix string) error {
+	err := registry.DeleteKey(root, prefix+originalSettingsKey)
+	if err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	// Родительский ключ удаляется, только если он пуст
+	registry.DeleteKey(root, prefix+strings.TrimSuffix(originalSettingsKey, `\OriginalSettings`))
+	return nil
+}
+
+// Refresh сообщает системе и запущенным приложениям WinINET текущего сеанса
+// о смене настроек. Запись в реестр уже выполнена, поэтому ошибки здесь не фатальны
+func (c *Config) Refresh() {
+	if !c.NoRefresh {
+		cmd := exec.Command("rundll32", "user32.dll,UpdatePerUserSystemParameters")
+		if err := cmd.Run(); err != nil {
+			c.logWarn(fmt.Sprintf("UpdatePerUserSystemParameters failed: %v", err))
+		}
+	}
+
+	const (
+		internetOptionRefresh         = 37
+		internetOptionSettingsChanged = 39
+	)
+	for _, option := range []uintptr{internetOptionSettingsChanged, internetOptionRefresh} {
+		ret, _, err := procInternetSetOption.Call(0, option, 0, 0)
+		if ret == 0 {
+			c.logWarn(fmt.Sprintf("InternetSetOption(%d) failed: %v", option, err))
+		}
+	}
+}
+
+// refreshSessions запускает SessionRefreshCommand в сеансе каждого
+// пользователя с его токеном: Refresh из сеанса 0 службы до WinINET
+// приложений пользователей не доходит
+func (c *Config) refreshSessions(sessions []SessionUser) {
+	if len(c.SessionRefreshCommand) == 0 {
+		c.logDebug("SessionRefreshCommand not set, user sessions not notified")
+		return
+	}
+
+	for _, session := range sessions {
+		if session.Token == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sessionRefreshTimeout)
+		cmd := exec.CommandContext(ctx, c.SessionRefreshCommand[0], c.SessionRefreshCommand[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Token:         syscall.Token(session.Token),
+			CreationFlags: windows.CREATE_NO_WINDOW,
+		}
+		if err := cmd.Run(); err != nil {
+			c.logWarn(fmt.Sprintf("Proxy refresh in session %d failed: %v", session.SessionID, err))
+		}
+		cancel()
+	}
+}
+
+// setWinHTTPProxy настраивает прокси WinHTTP, который используют службы
+// и фоновые приложения (в отличие от WinINET в HKCU)
+func (c *Config) setWinHTTPProxy(enable bool) error {
+	var cmd *exec.Cmd
+	if enable {
+		cmd = exec.Command("netsh", "winhttp", "set", "proxy",
+			"proxy-server="+c.winHTTPProxyServer(),
+			"bypass-list="+c.ProxyOverride())
+	} else {
+		cmd = exec.Command("netsh", "winhttp", "reset", "proxy")
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh winhttp failed: %v: %s", err, MaskCredentials(strings.TrimSpace(string(output))))
+	}
+	return nil
+}
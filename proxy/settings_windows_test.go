@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// fakeKey - ключ Internet Settings в памяти вместо реестра
+type fakeKey struct {
+	dwords map[string]uint32
+	texts  map[string]string
+
+	// Значение, запись которого один раз завершится ошибкой
+	failOnce string
+}
+
+func newFakeKey() *fakeKey {
+	return &fakeKey{dwords: make(map[string]uint32), texts: make(map[string]string)}
+}
+
+func (k *fakeKey) GetIntegerValue(name string) (uint64, uint32, error) {
+	value, ok := k.dwords[name]
+	if !ok {
+		return 0, 0, registry.ErrNotExist
+	}
+	return uint64(value), registry.DWORD, nil
+}
+
+func (k *fakeKey) GetStringValue(name string) (string, uint32, error) {
+	value, ok := k.texts[name]
+	if !ok {
+		return "", 0, registry.ErrNotExist
+	}
+	return value, registry.SZ, nil
+}
+
+func (k *fakeKey) SetDWordValue(name string, value uint32) error {
+	k.dwords[name] = value
+	return nil
+}
+
+func (k *fakeKey) SetStringValue(name, value string) error {
+	if name == k.failOnce {
+		k.failOnce = ""
+		return errors.New("access denied")
+	}
+	k.texts[name] = value
+	return nil
+}
+
+func (k *fakeKey) DeleteValue(name string) error {
+	_, isDWord := k.dwords[name]
+	_, isText := k.texts[name]
+	if !isDWord && !isText {
+		return registry.ErrNotExist
+	}
+	delete(k.dwords, name)
+	delete(k.texts, name)
+	return nil
+}
+
+// keyStore - ProxyStore поверх fakeKey
+type keyStore struct{ k *fakeKey }
+
+func (s keyStore) CurrentSettings() (bool, string, error) {
+	return readKeySettings(s.k)
+}
+
+func (s keyStore) SetProxy(enable bool, server, override string) error {
+	var enableValue uint32
+	if enable {
+		enableValue = 1
+	}
+	s.k.dwords["ProxyEnable"] = enableValue
+	s.k.texts["ProxyServer"] = server
+	s.k.texts["ProxyOverride"] = override
+	return nil
+}
+
+func TestCurrentSettingsMissingProxyEnable(t *testing.T) {
+	withServer := newFakeKey()
+	withServer.texts["ProxyServer"] = "10.0.66.52:3128"
+
+	enabled := newFakeKey()
+	enabled.dwords["ProxyEnable"] = 1
+	enabled.texts["ProxyServer"] = "10.0.66.52:3128"
+
+	tests := []struct {
+		name    string
+		key     *fakeKey
+		enabled bool
+		server  string
+	}{
+		{"clean profile", newFakeKey(), false, ""},
+		{"ProxyServer without ProxyEnable", withServer, false, "10.0.66.52:3128"},
+		{"ProxyEnable=1", enabled, true, "10.0.66.52:3128"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Store: keyStore{tt.key}}
+			gotEnabled, gotServer, err := c.CurrentSettings()
+			if err != nil {
+				t.Fatalf("CurrentSettings() error = %v", err)
+			}
+			if gotEnabled != tt.enabled || gotServer != tt.server {
+				t.Errorf("CurrentSettings() = %v, %q, want %v, %q", gotEnabled, gotServer, tt.enabled, tt.server)
+			}
+		})
+	}
+}
+
+func TestWriteSettingsRollback(t *testing.T) {
+	k := newFakeKey()
+	k.dwords["ProxyEnable"] = 0
+	k.texts["ProxyServer"] = "old.proxy:8080"
+	// ProxyEnable=1 записывается, запись ProxyServer следом завершается ошибкой
+	k.failOnce = "ProxyServer"
+
+	err := writeKeySettings(k, true, "10.0.66.52:3128", "<local>")
+	if err == nil {
+		t.Fatal("writeKeySettings() error = nil, want the injected failure")
+	}
+
+	if got := k.dwords["ProxyEnable"]; got != 0 {
+		t.Errorf("ProxyEnable = %d after rollback, want 0", got)
+	}
+	if got := k.texts["ProxyServer"]; got != "old.proxy:8080" {
+		t.Errorf("ProxyServer = %q after rollback, want %q", got, "old.proxy:8080")
+	}
+	if _, ok := k.texts["ProxyOverride"]; ok {
+		t.Errorf("ProxyOverride = %q after rollback, want it absent", k.texts["ProxyOverride"])
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Site - целевой шлюз с понятной меткой (название площадки) для логов
+type Site struct {
+	Label   string `json:"label"`
+	Gateway string `json:"gateway"`
+}
+
+// Sites разбирает GatewaySites вида "site1=10.0.1.1;site2=10.0.2.1".
+// Без GatewaySites целевой шлюз один - Gateway без метки
+func (c *Config) Sites() ([]Site, error) {
+	if c.GatewaySites == "" {
+		return []Site{{Gateway: c.Gateway}}, nil
+	}
+
+	var sites []Site
+	for _, entry := range splitList(c.GatewaySites) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid gateway site %q, expected label=gateway", entry)
+		}
+		site := Site{Label: strings.TrimSpace(parts[0]), Gateway: strings.TrimSpace(parts[1])}
+		if err := ValidateGatewayPattern(site.Gateway); err != nil {
+			return nil, fmt.Errorf("site %s: %v", site.Label, err)
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+// matchSite возвращает площадку, которой принадлежит шлюз gw. В Gateway
+// результата - сам найденный адрес, а не шаблон из настроек
+func (c *Config) matchSite(gw string) (Site, bool) {
+	sites, err := c.Sites()
+	if err != nil {
+		return Site{}, false
+	}
+	for _, site := range sites {
+		if GatewayMatches(site.Gateway, gw) {
+			return Site{Label: site.Label, Gateway: gw}, true
+		}
+	}
+	return Site{}, false
+}
+
+// gatewayPrefixPattern - начало адреса: "192.168." или "10.0.*"
+var gatewayPrefixPattern = regexp.MustCompile(`^(\d{1,3}\.){1,3}\*?$|^(\d{1,3}\.){0,3}\d{1,3}\*$`)
+
+// ValidateGatewayPattern проверяет шаблон шлюза: IP-адрес, CIDR или префикс
+func ValidateGatewayPattern(pattern string) error {
+	if net.ParseIP(pattern) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(pattern); err == nil {
+		return nil
+	}
+	if gatewayPrefixPattern.MatchString(pattern) {
+		return nil
+	}
+	return fmt.Errorf("invalid gateway %q: expected IP address, CIDR, or prefix like 192.168. or 10.0.*", pattern)
+}
+
+// AutoGateway - значение --gateway, которое при установке службы заменяется
+// текущим шлюзом по умолчанию, см. ResolveAutoGateway
+const AutoGateway = "auto"
+
+// ResolveAutoGateway заменяет Gateway=auto адресом текущего шлюза по умолчанию
+// и возвращает его. Другие значения Gateway не меняются
+func (c *Config) ResolveAutoGateway() (string, error) {
+	if c.Gateway != AutoGateway {
+		return c.Gateway, nil
+	}
+	gateway, err := c.gateways().DefaultGateway()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve --gateway=auto: %v", err)
+	}
+	if gateway == "" {
+		return "", fmt.Errorf("cannot resolve --gateway=auto: no default gateway")
+	}
+	c.Gateway = gateway
+	return gateway, nil
+}
+
+// GatewayMatches сравнивает адрес шлюза с шаблоном. Вид сравнения
+// определяется формой шаблона: CIDR - вхождение в подсеть, окончание на
+// '.' или '*' - префикс строки, иначе точное совпадение
+func GatewayMatches(pattern, gw string) bool {
+	if strings.HasSuffix(pattern, ".") || strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(gw, strings.TrimSuffix(pattern, "*"))
+	}
+	if strings.Contains(pattern, "/") {
+		_, subnet, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(gw)
+		return err == nil && ip != nil && subnet.Contains(ip)
+	}
+	return gw == pattern
+}
+
+// gatewayDescription - цель проверки шлюза для Decision.Reason
+func (c *Config) gatewayDescription(site Site) string {
+	if site.Gateway == "" {
+		if c.GatewaySites != "" {
+			return "gateway sites"
+		}
+		return "gateway " + c.Gateway
+	}
+	if site.Label == "" {
+		return "gateway " + site.Gateway
+	}
+	return fmt.Sprintf("gateway %s (site %s)", site.Gateway, site.Label)
+}
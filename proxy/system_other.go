@@ -0,0 +1,52 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"runtime"
+)
+
+// Вне Windows нет адаптеров iphlpapi, реестра, токенов и сеансов: пакет
+// собирается ради тестов логики решения с подставными GatewayProvider,
+// UserProvider и ProxyStore, системные источники возвращают errUnsupported
+
+var errUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+type systemGateways struct{ c *Config }
+
+func (systemGateways) DefaultGateway() (string, error)            { return "", errUnsupported }
+func (systemGateways) ActiveGateways() ([]string, error)          { return nil, errUnsupported }
+func (systemGateways) AdapterGateways() ([]AdapterGateway, error) { return nil, errUnsupported }
+
+type systemUsers struct{}
+
+func (systemUsers) CurrentUsername() (string, error)     { return CurrentUsername() }
+func (systemUsers) UserPrincipalName() (string, error)   { return "", errUnsupported }
+func (systemUsers) CurrentUserGroups() ([]string, error) { return nil, errUnsupported }
+func (systemUsers) CurrentUserSID() (string, error)      { return "", errUnsupported }
+
+type registryStore struct{ c *Config }
+
+func (*registryStore) CurrentSettings() (bool, string, error) { return false, "", errUnsupported }
+func (*registryStore) SetProxy(enable bool, server, override string) error {
+	return errUnsupported
+}
+
+func (c *Config) evaluateSessions() (Decision, error)  { return Decision{}, errUnsupported }
+func (c *Config) ActiveVPNAdapters() ([]string, error) { return nil, errUnsupported }
+
+func LocalSubnets() ([]*net.IPNet, error)             { return nil, errUnsupported }
+func DHCPOptionValues(code int) ([]DHCPOption, error) { return nil, errUnsupported }
+func ConnectionCost() (uint32, error)                 { return 0, errUnsupported }
+func CurrentSSIDs() ([]string, error)                 { return nil, errUnsupported }
+func DNSSuffixes() ([]string, error)                  { return nil, errUnsupported }
+func DNSServers() (map[string][]string, error)        { return nil, errUnsupported }
+func lookupARP(ip string) (string, error)             { return "", errUnsupported }
+
+func checkCommand(ctx context.Context, line string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", line)
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+func CurrentUsername() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return currentUser.Username, nil
+}
+
+// Имена учётных записей в Windows не зависят от регистра,
+// точное сравнение включается полем CaseSensitive
+func (c *Config) usernameEquals(name, pattern string) bool {
+	if isWildcard(pattern) {
+		return c.wildcardMatch(name, pattern, true)
+	}
+	if c.CaseSensitive {
+		return name == pattern
+	}
+	return strings.EqualFold(name, pattern)
+}
+
+func (c *Config) usernameContains(name, pattern string) bool {
+	if isWildcard(pattern) {
+		return c.wildcardMatch(name, pattern, false)
+	}
+	if c.CaseSensitive {
+		return strings.Contains(name, pattern)
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
+
+// Шаблоны с * и ? (*@contoso.com, AzureAD\*) нужны для облачных учётных
+// записей, у которых общий только домен или арендатор
+func isWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+// wildcardMatch сравнивает имя с шаблоном: целиком (anchored, для
+// FullUserName) или как подстроку (для FindUserName). Выражения заранее
+// компилирует CompileUserPatterns
+func (c *Config) wildcardMatch(name, pattern string, anchored bool) bool {
+	expr := c.wildcardExpr(pattern, anchored)
+	re, ok := c.userPatterns[expr]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return false
+		}
+	}
+	return re.MatchString(name)
+}
+
+func (c *Config) wildcardExpr(pattern string, anchored bool) string {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	if anchored {
+		expr = "^" + expr + "$"
+	}
+	if !c.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	return expr
+}
+
+// splitList разбирает список значений, разделённых точкой с запятой
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// MatchUsername проверяет имя по FullUserName, FindUserName и NameRegex
+// и возвращает описание сработавшего правила
+func (c *Config) MatchUsername(name string) (bool, string) {
+	// Проверяем полное совпадение
+	for _, full := range splitList(c.FullUserName) {
+		if c.usernameEquals(name, full) {
+			return true, "full username " + full
+		}
+	}
+
+	// Проверяем частичное совпадение
+	for _, part := range splitList(c.FindUserName) {
+		if c.usernameContains(name, part) {
+			return true, "partial username " + part
+		}
+	}
+
+	// Проверяем совпадение по регулярному выражению
+	if c.userNameRegex != nil && c.userNameRegex.MatchString(name) {
+		return true, "regex " + c.NameRegex
+	}
+
+	return false, ""
+}
+
+// userName - имя пользователя в одной из форм (SAM или UPN)
+type userName struct{ form, name string }
+
+// Имя проверяется и в форме DOMAIN\user, и как UPN (user@domain.com).
+// UPN есть только у доменных учётных записей
+func (c *Config) userNameForms(currentUser string) []userName {
+	names := []userName{{"SAM", currentUser}}
+	if upn, err := c.users().UserPrincipalName(); err == nil && upn != "" {
+		names = append(names, userName{"UPN", upn})
+	} else if err != nil {
+		c.logDebug(fmt.Sprintf("User principal name not available: %v", err))
+	}
+	return names
+}
+
+func (c *Config) CheckUser() (bool, error) {
+	currentUser, err := c.users().CurrentUsername()
+	if err != nil {
+		return false, err
+	}
+
+	c.logDebug(fmt.Sprintf("Current username: %s", currentUser))
+	if c.CaseSensitive {
+		c.logDebug("Username comparison: case-sensitive")
+	} else {
+		c.logDebug("Username comparison: case-insensitive")
+	}
+
+	for _, n := range c.userNameForms(currentUser) {
+		if matched, rule := c.MatchUsername(n.name); matched {
+			c.log(LevelInfo, fmt.Sprintf("Username %s (%s) matched %s", n.name, n.form, rule), map[string]string{"user": currentUser})
+			return true, nil
+		}
+		c.logDebug(fmt.Sprintf("Username %s (%s) does not match fullname=%q findname=%q nameregex=%q",
+			n.name, n.form, c.FullUserName, c.FindUserName, c.NameRegex))
+	}
+
+	return false, nil
+}
+
+// sidMatches сравнивает SID с шаблоном: точно или, если шаблон оканчивается
+// на *, по префиксу (S-1-5-21-1111-2222-3333-* - все учётные записи домена)
+func sidMatches(sid, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(strings.ToUpper(sid), strings.ToUpper(prefix))
+	}
+	return strings.EqualFold(sid, pattern)
+}
+
+func (c *Config) CheckSID() (bool, error) {
+	if c.SID == "" {
+		return false, nil
+	}
+
+	sid, err := c.users().CurrentUserSID()
+	if err != nil {
+		return false, err
+	}
+	if sid == "" {
+		c.logDebug("Current user SID is not available")
+		return false, nil
+	}
+
+	for _, pattern := range splitList(c.SID) {
+		if sidMatches(sid, pattern) {
+			c.logInfo(fmt.Sprintf("User SID %s matched %s", sid, pattern))
+			return true, nil
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("User SID %s does not match %s", sid, c.SID))
+	return false, nil
+}
+
+func (c *Config) CheckGroup() (bool, error) {
+	if c.Group == "" {
+		return false, nil
+	}
+
+	groups, err := c.users().CurrentUserGroups()
+	if err != nil {
+		return false, err
+	}
+
+	for _, group := range groups {
+		if strings.EqualFold(group, c.Group) {
+			c.logInfo(fmt.Sprintf("Group membership match: %s", c.Group))
+			return true, nil
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("Current user is not a member of group %s", c.Group))
+	return false, nil
+}
+
+// checkIdentity объединяет проверки по имени и по группе для режима both:
+// каждая заданная проверка должна пройти
+func (c *Config) checkIdentity() (bool, error) {
+	identityOk := true
+
+	if c.FullUserName != "" || c.FindUserName != "" || c.NameRegex != "" || c.Group == "" {
+		userOk, err := c.CheckUser()
+		if err != nil {
+			return false, err
+		}
+		identityOk = userOk
+	}
+
+	if c.Group != "" {
+		groupOk, err := c.CheckGroup()
+		if err != nil {
+			return false, err
+		}
+		identityOk = identityOk && groupOk
+	}
+
+	return identityOk, nil
+}
+
+func (c *Config) HasExclusions() bool {
+	return c.ExcludeFullName != "" || c.ExcludeFindName != ""
+}
+
+// CheckExcluded проверяет пользователя по ExcludeFullName и ExcludeFindName
+// и возвращает описание сработавшего исключения
+func (c *Config) CheckExcluded() (bool, string, error) {
+	if !c.HasExclusions() {
+		return false, "", nil
+	}
+
+	currentUser, err := c.users().CurrentUsername()
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, n := range c.userNameForms(currentUser) {
+		for _, full := range splitList(c.ExcludeFullName) {
+			if c.usernameEquals(n.name, full) {
+				return true, "excluded username " + full, nil
+			}
+		}
+		for _, part := range splitList(c.ExcludeFindName) {
+			if c.usernameContains(n.name, part) {
+				return true, "excluded partial username " + part, nil
+			}
+		}
+	}
+
+	return false, "", nil
+}
+
+// CheckHostname сравнивает имя компьютера с Hostname (точно) и HostnameFind
+// (подстрока), без учёта регистра. Нужен машинам без вошедшего пользователя
+func (c *Config) CheckHostname() (bool, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false, fmt.Errorf("cannot get computer name: %v", err)
+	}
+
+	for _, name := range splitList(c.Hostname) {
+		if strings.EqualFold(hostname, name) {
+			c.logInfo(fmt.Sprintf("Computer name %s matched %s", hostname, name))
+			return true, nil
+		}
+	}
+	for _, part := range splitList(c.HostnameFind) {
+		if strings.Contains(strings.ToLower(hostname), strings.ToLower(part)) {
+			c.logInfo(fmt.Sprintf("Computer name %s contains %s", hostname, part))
+			return true, nil
+		}
+	}
+
+	c.logDebug(fmt.Sprintf("Computer name %s does not match hostname=%q hostname-find=%q", hostname, c.Hostname, c.HostnameFind))
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import "testing"
+
+func TestMatchUsernameAzureAD(t *testing.T) {
+	tests := []struct {
+		name          string
+		fullName      string
+		findName      string
+		caseSensitive bool
+		user          string
+		want          bool
+	}{
+		{"AzureAD wildcard", `AzureAD\*`, "", false, `AzureAD\IvanPetrov`, true},
+		{"AzureAD wildcard, domain user", `AzureAD\*`, "", false, `ESPD\ivanov`, false},
+		{"AzureAD exact, other case", `azuread\ivanpetrov`, "", false, `AzureAD\IvanPetrov`, true},
+		{"AzureAD wildcard, case sensitive", `AzureAD\*`, "", true, `azuread\IvanPetrov`, false},
+		{"tenant wildcard", "*@contoso.onmicrosoft.com", "", false, "ivan.petrov@contoso.onmicrosoft.com", true},
+		{"tenant wildcard, other tenant", "*@contoso.onmicrosoft.com", "", false, "ivan.petrov@fabrikam.onmicrosoft.com", false},
+		{"tenant wildcard is anchored", "*@contoso.onmicrosoft.com", "", false, "ivan.petrov@contoso.onmicrosoft.com.example", false},
+		{"UPN exact", "ivan.petrov@espd.ru", "", false, "Ivan.Petrov@espd.ru", true},
+		{"UPN partial", "", "@contoso.onmicrosoft.com", false, "ivan.petrov@contoso.onmicrosoft.com", true},
+		{"UPN partial wildcard", "", "petrov@*.onmicrosoft", false, "ivan.petrov@contoso.onmicrosoft.com", true},
+		{"single character wildcard", `AzureAD\user?`, "", false, `AzureAD\user7`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{FullUserName: tt.fullName, FindUserName: tt.findName, CaseSensitive: tt.caseSensitive}
+			if err := c.CompileUserPatterns(); err != nil {
+				t.Fatalf("CompileUserPatterns() error = %v", err)
+			}
+			if got, rule := c.MatchUsername(tt.user); got != tt.want {
+				t.Errorf("MatchUsername(%q) = %v (%s), want %v", tt.user, got, rule, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileUserPatterns(t *testing.T) {
+	c := &Config{
+		FullUserName:    `AzureAD\*;ESPD\ivanov`,
+		FindUserName:    "@contoso.onmicrosoft.com;svc_?",
+		ExcludeFullName: `AzureAD\admin*`,
+	}
+	if err := c.CompileUserPatterns(); err != nil {
+		t.Fatalf("CompileUserPatterns() error = %v", err)
+	}
+	// Только шаблоны с * и ?: точные имена и подстроки сравниваются без regexp
+	if got := len(c.userPatterns); got != 3 {
+		t.Errorf("compiled %d patterns, want 3", got)
+	}
+}
+
+func TestCheckUserAzureADUPN(t *testing.T) {
+	azureUser := fakeUsers{name: `AzureAD\IvanPetrov`, upn: "ivan.petrov@contoso.onmicrosoft.com"}
+
+	c := &Config{
+		Mode:         "user",
+		FullUserName: "*@contoso.onmicrosoft.com",
+		Users:        azureUser,
+	}
+	if err := c.CompileUserPatterns(); err != nil {
+		t.Fatalf("CompileUserPatterns() error = %v", err)
+	}
+	ok, err := c.CheckUser()
+	if err != nil {
+		t.Fatalf("CheckUser() error = %v", err)
+	}
+	if !ok {
+		t.Errorf("CheckUser() = false, want true: the UPN should match the tenant pattern")
+	}
+
+	c = &Config{
+		ExcludeFullName: `AzureAD\*`,
+		Users:           azureUser,
+	}
+	if err := c.CompileUserPatterns(); err != nil {
+		t.Fatalf("CompileUserPatterns() error = %v", err)
+	}
+	excluded, rule, err := c.CheckExcluded()
+	if err != nil {
+		t.Fatalf("CheckExcluded() error = %v", err)
+	}
+	if !excluded {
+		t.Errorf("CheckExcluded() = false, want true for %s", azureUser.name)
+	} else if rule != `excluded username AzureAD\*` {
+		t.Errorf("CheckExcluded() rule = %q", rule)
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// identityCacheKey хранит UPN облачных учётных записей по SID
+const identityCacheKey = `SOFTWARE\Microsoft\IdentityStore\Cache\`
+
+// UserPrincipalName возвращает UPN текущего пользователя. Для учётных записей
+// AzureAD\user GetUserNameEx(NameUserPrincipal) обычно завершается ошибкой,
+// тогда UPN (user@tenant.onmicrosoft.com) берётся из кэша IdentityStore
+func UserPrincipalName() (string, error) {
+	lookup := func() (string, error) { return UserNameEx(windows.NameUserPrincipal) }
+	return principalName(lookup, CurrentUsername, CurrentUserSID)
+}
+
+func cloudUserPrincipalName(sid string) (string, error) {
+	path := identityCacheKey + sid + `\IdentityCache\` + sid
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return "", fmt.Errorf("Azure AD identity cache for %s not found: %v", sid, err)
+	}
+	defer k.Close()
+
+	upn, _, err := k.GetStringValue("UserName")
+	if err != nil {
+		return "", fmt.Errorf("Azure AD identity cache for %s has no UserName: %v", sid, err)
+	}
+	return upn, nil
+}
+
+// UserNameEx возвращает имя текущего пользователя в заданном формате
+// (windows.NameSamCompatible, windows.NameUserPrincipal и т.д.)
+func UserNameEx(format uint32) (string, error) {
+	size := uint32(256)
+	for {
+		buf := make([]uint16, size)
+		err := windows.GetUserNameEx(format, &buf[0], &size)
+		if err == nil {
+			return windows.UTF16ToString(buf[:size]), nil
+		}
+		if err != windows.ERROR_MORE_DATA {
+			return "", err
+		}
+	}
+}
+
+func CurrentUserGroups() ([]string, error) {
+	return tokenGroups(windows.GetCurrentProcessToken())
+}
+
+// tokenGroups возвращает группы токена в виде SID, имени и DOMAIN\имени
+func tokenGroups(token windows.Token) ([]string, error) {
+	info, err := token.GetTokenGroups()
+	if err != nil {
+		return nil, fmt.Errorf("GetTokenInformation failed: %v", err)
+	}
+
+	var groups []string
+	for _, group := range info.AllGroups() {
+		groups = append(groups, group.Sid.String())
+
+		account, domain, _, err := group.Sid.LookupAccount("")
+		if err != nil {
+			continue
+		}
+		groups = append(groups, account)
+		if domain != "" {
+			groups = append(groups, domain+"\\"+account)
+		}
+	}
+
+	return groups, nil
+}
+
+// CurrentUserSID возвращает SID учётной записи процесса
+func CurrentUserSID() (string, error) {
+	tokenUser, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "", fmt.Errorf("GetTokenInformation failed: %v", err)
+	}
+	return tokenUser.User.Sid.String(), nil
+}
+
+// azureADDomain - домен, под которым Windows показывает учётные записи Entra ID (Azure AD)
+const azureADDomain = "AzureAD"
+
+// principalName - UPN через lookup с запасным путём через кэш IdentityStore
+// для AzureAD\user; name и sid возвращают имя и SID той же учётной записи
+func principalName(lookup, name, sid func() (string, error)) (string, error) {
+	upn, err := lookup()
+	if err == nil && upn != "" {
+		return upn, nil
+	}
+
+	account, nameErr := name()
+	if nameErr != nil || !strings.HasPrefix(strings.ToLower(account), strings.ToLower(azureADDomain)+`\`) {
+		return upn, err
+	}
+
+	userSID, sidErr := sid()
+	if sidErr != nil {
+		return "", sidErr
+	}
+	return cloudUserPrincipalName(userSID)
+}